@@ -0,0 +1,167 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Blocklist は接続を拒否する接続先の一覧。
+type Blocklist struct {
+	exact  map[string][]string // ホスト名ごとのパスの前方一致の規則。空文字列はホスト全体。
+	suffix map[string][]string // サブドメインも含めて一致させるホスト名ごとのパスの規則。
+	regex  []*regexp.Regexp
+	files  []string // 規則を読み込んだ一覧ファイル。
+	n      int
+}
+
+// add は "example.com" や "example.com/ads/" のような表記の規則を m に追加する。
+func (b *Blocklist) add(m map[string][]string, s string) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	host, path := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		host, path = s[:i], s[i:]
+	}
+	m[host] = append(m[host], path)
+	b.n++
+}
+
+// Len は規則の数を返す。
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return b.n
+}
+
+// Files は規則を読み込んだ一覧ファイルの名前を返す。
+func (b *Blocklist) Files() []string {
+	if b == nil {
+		return nil
+	}
+	return b.files
+}
+
+// matchPath は path が paths のいずれかに前方一致すればその規則を返す。
+func matchPath(paths []string, path string) (string, bool) {
+	for _, p := range paths {
+		if strings.HasPrefix(path, p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Match は host の path へのリクエストが拒否の対象かを調べ、一致した規則を返す。
+// CONNECT のようにパスが分からない場合は path に空文字列を渡すと、パスを含まない規則だけを調べる。
+// 正規表現は "example.com/path" のようにホスト名とパスを繋げた文字列に対して調べる。
+func (b *Blocklist) Match(host, path string) (rule string, ok bool) {
+	if b == nil {
+		return "", false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	lpath := strings.ToLower(path)
+	if p, ok := matchPath(b.exact[host], lpath); ok {
+		return host + p, true
+	}
+	for h := host; h != ""; {
+		if p, ok := matchPath(b.suffix[h], lpath); ok {
+			return "*." + h + p, true
+		}
+		i := strings.Index(h, ".")
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	for _, re := range b.regex {
+		if re.MatchString(host + path) {
+			return re.String(), true
+		}
+	}
+	return "", false
+}
+
+// loadFile は hosts 形式または Adblock 形式の一覧を読み込む。
+//
+//	0.0.0.0 example.com      # hosts 形式: 一致するホスト名
+//	||example.com^           # Adblock 形式: サブドメインを含めて一致
+//	||example.com/ads/       # Adblock 形式: パスの前方一致
+//	example.com              # ホスト名だけの行: 一致するホスト名
+//
+// コメントと、例外 (@@) や要素の非表示 (##) など扱えない Adblock の規則は無視する。
+func (b *Blocklist) loadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 && !strings.Contains(line, "##") {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "!"), strings.HasPrefix(line, "["):
+		case strings.HasPrefix(line, "||"):
+			// ワイルドカードやオプションの付いた規則は扱わない
+			rule := strings.TrimSuffix(strings.TrimPrefix(line, "||"), "^")
+			if strings.ContainsAny(rule, "*^$#@|") {
+				continue
+			}
+			b.add(b.suffix, rule)
+		case strings.ContainsAny(line, "@#|$^*"):
+		default:
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+				fields = fields[1:]
+			} else if len(fields) != 1 {
+				continue
+			}
+			for _, host := range fields {
+				switch host {
+				case "localhost", "localhost.localdomain", "local", "broadcasthost",
+					"ip6-localhost", "ip6-loopback", "0.0.0.0":
+					continue
+				}
+				b.add(b.exact, host)
+			}
+		}
+	}
+	return s.Err()
+}
+
+// newBlocklist は設定ファイルに記述された規則と一覧ファイルから Blocklist を作成する。
+func newBlocklist(exact, suffix, regex, files []string) (*Blocklist, error) {
+	b := &Blocklist{
+		exact:  make(map[string][]string),
+		suffix: make(map[string][]string),
+	}
+	for _, s := range exact {
+		b.add(b.exact, s)
+	}
+	for _, s := range suffix {
+		b.add(b.suffix, strings.TrimPrefix(s, "*."))
+	}
+	for _, s := range regex {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist.regex: %v", err)
+		}
+		b.regex = append(b.regex, re)
+		b.n++
+	}
+	for _, f := range files {
+		if err := b.loadFile(f); err != nil {
+			return nil, fmt.Errorf("blocklist.files: %v", err)
+		}
+		b.files = append(b.files, f)
+	}
+	return b, nil
+}
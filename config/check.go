@@ -0,0 +1,154 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Problem は設定ファイルの検証で見つかった問題ひとつ分。
+type Problem struct {
+	Line  int    // 問題のある設定項目の行番号。分からない場合は 0。
+	Entry string // 問題のある設定項目。
+	Err   error
+}
+
+// Problems は設定ファイルの検証で見つかった全ての問題。New がエラーとして返す。
+type Problems struct {
+	File string
+	List []Problem
+}
+
+// Error は問題を "config.toml:12: reverse "41000->example.com": ..." の形式で一行ずつ並べる。
+func (p *Problems) Error() string {
+	lines := make([]string, len(p.List))
+	for i, pr := range p.List {
+		loc := p.File
+		if pr.Line > 0 {
+			loc += ":" + strconv.Itoa(pr.Line)
+		}
+		lines[i] = fmt.Sprintf("%s: %s: %v", loc, pr.Entry, pr.Err)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// location は設定項目とその行番号。
+type location struct {
+	entry string
+	line  int
+}
+
+// checker は設定ファイルの問題を設定項目の位置と共に記録する。
+// TOML のデコーダは位置を教えてくれないため、行番号は設定ファイルの文字列を探して求める。
+type checker struct {
+	file     string
+	lines    []string
+	problems []Problem
+}
+
+func newChecker(tomlfile string) *checker {
+	c := &checker{file: tomlfile}
+	if b, err := os.ReadFile(tomlfile); err == nil {
+		c.lines = strings.Split(string(b), "\n")
+	}
+	return c
+}
+
+// find は text を含む最初の行の行番号を返す。コメントの行は除く。見つからない場合は 0 を返す。
+func (c *checker) find(text string) int {
+	for i, l := range c.lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "#") {
+			continue
+		}
+		if strings.Contains(l, text) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// isHeader は l が header だけの行 (後ろのコメントは除く) かどうかを返す。
+func isHeader(l, header string) bool {
+	rest := strings.TrimSpace(l)
+	if !strings.HasPrefix(rest, header) {
+		return false
+	}
+	rest = strings.TrimSpace(rest[len(header):])
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
+
+// table は [name] の表の位置を返す。
+func (c *checker) table(name string) location {
+	loc := location{entry: "[" + name + "]"}
+	for i, l := range c.lines {
+		if isHeader(l, "["+name+"]") {
+			loc.line = i + 1
+			break
+		}
+	}
+	return loc
+}
+
+// arrayTable は n 番目 (0 から数える) の [[name]] の表の位置を返す。
+func (c *checker) arrayTable(name string, n int) location {
+	loc := location{entry: fmt.Sprintf("[[%s]] #%d", name, n+1)}
+	for i, l := range c.lines {
+		if isHeader(l, "[["+name+"]]") {
+			if n == 0 {
+				loc.line = i + 1
+				break
+			}
+			n--
+		}
+	}
+	return loc
+}
+
+// value は文字列の配列 name の要素 v の位置を返す。
+func (c *checker) value(name, v string) location {
+	return location{entry: fmt.Sprintf("%s %q", name, v), line: c.find(strconv.Quote(v))}
+}
+
+// add は loc の設定項目の問題として err を記録する。
+func (c *checker) add(loc location, err error) {
+	c.problems = append(c.problems, Problem{Line: loc.line, Entry: loc.entry, Err: err})
+}
+
+// err は記録した問題があればそれらを行番号の順にまとめたエラーを返す。
+func (c *checker) err() error {
+	if len(c.problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i].Line, c.problems[j].Line
+		return a != 0 && (b == 0 || a < b)
+	})
+	return &Problems{File: c.file, List: c.problems}
+}
+
+// checkPort は port が TCP や UDP のポート番号として使えるかを調べる。
+func checkPort(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port number out of range: %d", port)
+	}
+	return nil
+}
+
+// checkAddr は addr が "example.com:80" のようにホスト名とポート番号を持つ接続先かを調べる。
+func checkAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in address %s", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid port in address %s", addr)
+	}
+	return checkPort(p)
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testChecker は設定ファイルの内容が toml の checker を作る。
+func testChecker(toml string) *checker {
+	return &checker{file: "config.toml", lines: strings.Split(toml, "\n")}
+}
+
+const checkTOML = `# [sni.41443] の例
+# reverse = ["41000->a.example:22"]
+use_proxy = "p"
+reverse = [
+  "41000->a.example:22",
+  "41001->b.example:22",
+]
+[sni.41443.routes]
+"a.example" = "a.internal:443"
+  [sni.41443]   # ルートの表
+default = "web.internal:443"
+[[reverse_x]]
+[[reverse]]
+[[reverse]] # 2番目
+`
+
+func TestCheckerLocation(t *testing.T) {
+	c := testChecker(checkTOML)
+	tests := []struct {
+		name string
+		loc  location
+		want location
+	}{
+		// コメントの行は飛ばす
+		{"value", c.value("reverse", "41000->a.example:22"), location{`reverse "41000->a.example:22"`, 5}},
+		{"second value", c.value("reverse", "41001->b.example:22"), location{`reverse "41001->b.example:22"`, 6}},
+		{"find", location{"use_proxy", c.find("use_proxy")}, location{"use_proxy", 3}},
+		{"find missing", location{"dns", c.find("[dns]")}, location{"dns", 0}},
+		// 表の見出しは見出し全体で一致させ、子の表や前後の空白、後ろのコメントを区別する
+		{"table", c.table("sni.41443"), location{"[sni.41443]", 10}},
+		{"child table", c.table("sni.41443.routes"), location{"[sni.41443.routes]", 8}},
+		{"missing table", c.table("sni.41444"), location{"[sni.41444]", 0}},
+		{"array table", c.arrayTable("reverse", 0), location{"[[reverse]] #1", 13}},
+		{"second array table", c.arrayTable("reverse", 1), location{"[[reverse]] #2", 14}},
+		{"missing array table", c.arrayTable("reverse", 2), location{"[[reverse]] #3", 0}},
+	}
+	for _, tt := range tests {
+		if tt.loc != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, tt.loc, tt.want)
+		}
+	}
+}
+
+func TestIsHeader(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"[http]", true},
+		{"  [http]  ", true},
+		{"[http] # コメント", true},
+		{"[http]#コメント", true},
+		{"[http.listen]", false},
+		{"[https]", false},
+		{"# [http]", false},
+		{`x = "[http]"`, false},
+		{"[http] x = 1", false},
+	}
+	for _, tt := range tests {
+		if got := isHeader(tt.line, "[http]"); got != tt.want {
+			t.Errorf("isHeader(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestProblems(t *testing.T) {
+	c := testChecker(checkTOML)
+	if err := c.err(); err != nil {
+		t.Fatalf("err() = %v, want nil", err)
+	}
+	// 行番号の順に並び、行番号が分からないものは記録した順に最後に並ぶ
+	c.add(location{entry: "flags"}, errors.New("e1"))
+	c.add(c.table("sni.41443"), errors.New("e2"))
+	c.add(location{entry: "other"}, errors.New("e3"))
+	c.add(location{entry: "use_proxy", line: c.find("use_proxy")}, errors.New("e4"))
+	c.add(c.table("sni.41443"), errors.New("e5"))
+	want := `config.toml:3: use_proxy: e4
+config.toml:10: [sni.41443]: e2
+config.toml:10: [sni.41443]: e5
+config.toml: flags: e1
+config.toml: other: e3`
+	if got := c.err().Error(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
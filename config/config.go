@@ -3,17 +3,282 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 // Config は設定情報を管理するための構造体。
 type Config struct {
-	Proxy       *Proxy              // proxy-relay が接続しに行くプロキシサーバの設定。
-	ReverseMap  map[int]string      // 特定のホストの特定のポート番号に接続するリバースプロキシ設定のリスト。
-	DirectHosts map[string]struct{} // プロキシを使わずに接続するホスト名の一覧。
+	Proxy          *Proxy              // proxy-relay が接続しに行くプロキシサーバの設定。
+	HTTPListen     []string            // -proxy_port の他に HTTP プロキシとして待ち受けるアドレス。"unix:/path" か "host:port" の形式。
+	HTTPSocket     SocketOptions       // HTTP プロキシを Unix ソケットで待ち受ける際のファイルの権限。
+	Reverse        []*Reverse          // 特定のホストの特定のポート番号に接続するリバースプロキシ設定のリスト。
+	SNIRoutes      map[int]*SNIRoute   // TLS の SNI で接続先を選ぶリバースプロキシ設定のリスト。
+	VHosts         map[int]*VHostRoute // HTTP の Host ヘッダで接続先を選ぶリバースプロキシ設定のリスト。
+	DirectHosts    map[string]struct{} // プロキシを使わずに接続するホスト名の一覧。
+	Timeouts       Timeouts            // 中継する接続全体に適用する時間制限。
+	Transport      Transport           // 上流の HTTP プロキシへの接続プールの設定。
+	ForwardHeaders ForwardHeaders      // 上流へ送るリクエストにクライアントの情報を付けるかどうかの設定。
+	HeaderRules    []HeaderRule        // 接続先ごとにリクエストとレスポンスのヘッダを書き換える規則。
+	MITM           MITM                // CONNECT の TLS を終端して中身を検査する設定。
+	Blocklist      *Blocklist          // 接続を拒否する接続先の一覧。
+	BlockPage      string              // 拒否した際に返す HTML のテンプレートのファイル名。空の場合は既定のものを使う。
+	Cache          Cache               // HTTP のレスポンスをディスクにキャッシュする設定。
+	DNS            DNS                 // 上流を経由して名前解決する DNS サーバの設定。
+	Hosts          map[string]net.IP   // 名前解決せずに使う IP アドレス。ホスト名は小文字。
+	ResolveRules   []ResolveRule       // 接続先ごとの名前解決の方法。一致しなければ Proxy.Resolve を使う。
+	Transparent    Transparent         // REDIRECT された接続を受け付ける透過プロキシの設定。
+}
+
+// Transparent は透過プロキシの設定。Port が 0 の場合は待ち受けない。
+type Transparent struct {
+	Port  int  // REDIRECT された接続を受け付けるポート番号。
+	Sniff bool // TLS の SNI や HTTP の Host ヘッダから接続先のホスト名を読み取るかどうか。
+}
+
+// DNS は DNS の問い合わせを上流の SOCKS プロキシを経由して転送する設定。Port が 0 の場合は待ち受けない。
+type DNS struct {
+	Port         int    // UDP と TCP で待ち受けるポート番号。
+	Server       string // 上流の向こう側で問い合わせる DNS サーバ。"10.0.0.53:53" の形式。
+	DirectServer string // DirectHosts の名前を問い合わせる DNS サーバ。空の場合は /etc/resolv.conf のものを使う。
+}
+
+// ServerTLS はリバースプロキシで TLS を終端するための設定。
+type ServerTLS struct {
+	CertFile string // 証明書のファイル名。空の場合は自己署名の証明書を使う。
+	KeyFile  string // 秘密鍵のファイル名。
+	ClientCA string // クライアント証明書を検証する認証局の証明書のファイル名。空の場合はクライアント証明書を求めない。
+}
+
+// ClientTLS はリバースプロキシで接続先との間の TLS を開始するための設定。
+type ClientTLS struct {
+	ServerName string // 接続先へ送る SNI と証明書の検証に使うホスト名。
+	CAFile     string // 接続先の証明書を検証する認証局の証明書のファイル名。空の場合はシステムの認証局を使う。
+	CertFile   string // 接続先へ提示するクライアント証明書のファイル名。空の場合は提示しない。
+	KeyFile    string // クライアント証明書の秘密鍵のファイル名。
+}
+
+// Cache は HTTP のレスポンスをディスクにキャッシュする設定。Dir が空の場合はキャッシュしない。
+type Cache struct {
+	Dir     string // キャッシュを保存するディレクトリ。
+	MaxSize int64  // キャッシュ全体の最大のバイト数。超えた場合は最も長く使われていないものから削除する。
+}
+
+// DefaultCacheSize は Cache.MaxSize が省略された場合に使用する値。
+const DefaultCacheSize = 1 << 30
+
+// MITM は CONNECT の TLS を終端するための設定。Hosts が空の場合は終端しない。
+type MITM struct {
+	Hosts  []string // TLS を終端する接続先のホスト名のパターン。MatchHost の形式。
+	CACert string   // 証明書の発行に使う認証局の証明書のファイル名。
+	CAKey  string   // 認証局の秘密鍵のファイル名。
+}
+
+// HeaderRule は条件に一致したリクエストとそのレスポンスのヘッダを書き換える規則。
+// 条件が空の項目は全てに一致する。
+type HeaderRule struct {
+	Host     string        // 接続先のホスト名。"*.example.com" のようにサブドメインを指定できる。
+	Method   string        // リクエストメソッド。
+	Path     string        // パス。末尾が "*" の場合は前方一致。
+	Request  HeaderActions // リクエストヘッダに対する操作。
+	Response HeaderActions // レスポンスヘッダに対する操作。
+}
+
+// HeaderActions はヘッダに対する操作。Remove, Set, Add の順に適用する。
+type HeaderActions struct {
+	Set    map[string]string // 値を置き換える。
+	Add    map[string]string // 値を追加する。
+	Remove []string          // 削除する。
+}
+
+// Match は host, method, path へのリクエストが規則の条件に一致するかを返す。host はポート番号を含まない。
+func (hr *HeaderRule) Match(host, method, path string) bool {
+	if hr.Host != "" && !MatchHost(hr.Host, host) {
+		return false
+	}
+	if hr.Method != "" && !strings.EqualFold(hr.Method, method) {
+		return false
+	}
+	if hr.Path != "" {
+		if strings.HasSuffix(hr.Path, "*") {
+			return strings.HasPrefix(path, strings.TrimSuffix(hr.Path, "*"))
+		}
+		return path == hr.Path
+	}
+	return true
+}
+
+// MatchHost は host が pattern に一致するかを返す。
+// pattern が "*.example.com" の場合は example.com のサブドメインに、"*" の場合は全てに一致する。
+func MatchHost(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// HeaderMode はクライアントの情報を伝えるヘッダを上流へ送るかどうかの設定。
+type HeaderMode int
+
+const (
+	HeaderOff     HeaderMode = iota // 送らない。クライアントから受け取った値も削除する。
+	HeaderOn                        // 送る。クライアントから受け取った値は信頼できるクライアントからの場合だけ引き継ぐ。
+	HeaderTrusted                   // 信頼できるクライアントからのリクエストにだけ送る。
+)
+
+func (m *HeaderMode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "off":
+		*m = HeaderOff
+	case "on":
+		*m = HeaderOn
+	case "trusted":
+		*m = HeaderTrusted
+	default:
+		return fmt.Errorf("invalid header mode: %q (must be on, off or trusted)", text)
+	}
+	return nil
+}
+
+func (m HeaderMode) String() string {
+	switch m {
+	case HeaderOn:
+		return "on"
+	case HeaderTrusted:
+		return "trusted"
+	}
+	return "off"
+}
+
+// ForwardHeaders は X-Forwarded-For などのヘッダの扱いを決める設定。
+type ForwardHeaders struct {
+	XForwardedFor HeaderMode
+	XRealIP       HeaderMode
+	Forwarded     HeaderMode   // RFC 7239
+	Via           string       // Via ヘッダで名乗る名前。空の場合は Via ヘッダを付けない。
+	Trusted       []*net.IPNet // 信頼できるクライアントのアドレス。
+}
+
+// IsTrusted は ip が信頼できるクライアントのアドレスかを返す。
+func (f *ForwardHeaders) IsTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPNet は "192.168.0.0/16" または "192.168.1.12" の形式のアドレスを解釈する。
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Transport は上流の HTTP プロキシへの接続を使いまわすための設定。
+// 省略した場合 MaxIdleConnsPerHost と IdleConnTimeout には DefaultTransport の値を使用し、ResponseHeaderTimeout は制限しない。
+type Transport struct {
+	MaxIdleConnsPerHost   int           // 上流ごとに保持する待機中の接続の最大数。
+	IdleConnTimeout       time.Duration // 待機中の接続を閉じるまでの時間。
+	ResponseHeaderTimeout time.Duration // リクエストを送ってからレスポンスヘッダを受け取るまでの最大時間。
+}
+
+// Timeouts は中継する接続に適用する時間制限の設定。0 の場合は制限しない。
+type Timeouts struct {
+	Idle        time.Duration // どちらの方向にも通信が無い状態がこの時間続いたら切断する。
+	MaxDuration time.Duration // 接続してからこの時間が経過したら切断する。
+	Dial        time.Duration // 上流のプロキシを経由して接続先に繋ぐまでにかける最大時間。
+}
+
+// inherit は t で設定されていない項目を def の値で埋めたものを返す。
+func (t Timeouts) inherit(def Timeouts) Timeouts {
+	if t.Idle == 0 {
+		t.Idle = def.Idle
+	}
+	if t.MaxDuration == 0 {
+		t.MaxDuration = def.MaxDuration
+	}
+	if t.Dial == 0 {
+		t.Dial = def.Dial
+	}
+	return t
+}
+
+// duration は TOML 上で "30s" や "5m" のように記述された時間を読み込むための型。
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// size は TOML 上で "512MB" や "2GB" のように記述されたバイト数を読み込むための型。
+type size int64
+
+func (sz *size) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	s = strings.TrimSuffix(s, "B")
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		unit = 1 << 40
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size: %q", text)
+	}
+	*sz = size(n * unit)
+	return nil
+}
+
+// timeouts は TOML 上の時間制限の設定。
+type timeouts struct {
+	IdleTimeout duration `toml:"idle_timeout"`
+	MaxDuration duration `toml:"max_duration"`
+	DialTimeout duration `toml:"dial_timeout"`
+}
+
+func (t timeouts) Timeouts() Timeouts {
+	return Timeouts{
+		Idle:        t.IdleTimeout.Duration,
+		MaxDuration: t.MaxDuration.Duration,
+		Dial:        t.DialTimeout.Duration,
+	}
 }
 
 // Proxy はプロキシひとつひとつの設定情報を管理するための構造体。
@@ -24,43 +289,298 @@ type Proxy struct {
 	SOCKSPort int `toml:"socks_port"`
 	Username  string
 	Password  string
+	Resolve   ResolveMode // 接続先のホスト名をどこで名前解決するか。
+}
+
+// DefaultTransport は Transport の項目が省略された場合に使用する値。
+var DefaultTransport = Transport{
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// relativePath は設定ファイル tomlfile からの相対パスとして name を解決する。name が空の場合は def を使用する。
+func relativePath(tomlfile, name, def string) string {
+	if name == "" {
+		name = def
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(tomlfile), name)
+}
+
+// withDefaultPort は addr にポート番号が含まれていなければ port を付ける。
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// optionalPath は name が空でなければ relativePath と同じく設定ファイルからの相対パスとして解決する。
+func optionalPath(tomlfile, name string) string {
+	if name == "" {
+		return ""
+	}
+	return relativePath(tomlfile, name, "")
 }
 
 // New は TOML ファイルを開き、中から設定情報を読み出し適切な形に分解して返す。
-func New(tomlfile string) (*Config, error) {
+// proxyPort から numPorts 個のポート番号は -proxy_port と -ports で HTTP プロキシが待ち受けるもので、他の設定と重複していないかも調べる。
+func New(tomlfile string, proxyPort, numPorts int) (*Config, error) {
 	var cfg struct {
-		UseProxy    string `toml:"use_proxy"`
-		Reverse     []string
-		DirectHosts []string `toml:"direct_hosts"`
-		Proxies     map[string]*Proxy
+		UseProxy string `toml:"use_proxy"`
+		HTTP     struct {
+			Listen      []string
+			SocketMode  string `toml:"socket_mode"`
+			SocketOwner string `toml:"socket_owner"`
+		}
+		Reverse        toml.Primitive
+		ReverseOptions map[string]reverseOptions `toml:"reverse_options"`
+		DirectHosts    []string                  `toml:"direct_hosts"`
+		Proxies        map[string]*Proxy
+		IdleTimeout    duration `toml:"idle_timeout"`
+		MaxDuration    duration `toml:"max_duration"`
+		DialTimeout    duration `toml:"dial_timeout"`
+		Transport      struct {
+			MaxIdleConnsPerHost   int      `toml:"max_idle_conns_per_host"`
+			IdleConnTimeout       duration `toml:"idle_conn_timeout"`
+			ResponseHeaderTimeout duration `toml:"response_header_timeout"`
+		}
+		ForwardHeaders struct {
+			XForwardedFor HeaderMode `toml:"x_forwarded_for"`
+			XRealIP       HeaderMode `toml:"x_real_ip"`
+			Forwarded     HeaderMode `toml:"forwarded"`
+			Via           *string
+			Trusted       []string
+		} `toml:"forward_headers"`
+		HeaderRules []HeaderRule `toml:"header_rules"`
+		MITM        struct {
+			Hosts  []string
+			CACert string `toml:"ca_cert"`
+			CAKey  string `toml:"ca_key"`
+		}
+		Blocklist struct {
+			Exact  []string
+			Suffix []string
+			Regex  []string
+			Files  []string
+			Page   string
+		}
+		Cache struct {
+			Dir     string
+			MaxSize size `toml:"max_size"`
+		}
+		Hosts        map[string]string
+		ResolveRules []ResolveRule `toml:"resolve_rules"`
+		Transparent  Transparent
+		SNI          map[string]hostRoute
+		VHost        map[string]hostRoute
+		DNS          struct {
+			Port         int
+			Server       string
+			DirectServer string `toml:"direct_server"`
+		}
 	}
-	if _, err := toml.DecodeFile(tomlfile, &cfg); err != nil {
+	md, err := toml.DecodeFile(tomlfile, &cfg)
+	if err != nil {
 		return nil, err
 	}
 
 	var r Config
 
-	// cfg.Reverse に格納された "41000->example.com:8080" のような表記のデータを分解する
-	r.ReverseMap = make(map[int]string)
-	for _, mapping := range cfg.Reverse {
-		kv := strings.SplitN(mapping, "->", 2)
-		if len(kv) != 2 {
-			return nil, fmt.Errorf("could not parse mapping setting: %s", mapping)
+	// 待ち受けるポートと接続先の設定は、問題を全て chk に記録してから最後にまとめて返す
+	chk := newChecker(tomlfile)
+	px, ok := cfg.Proxies[cfg.UseProxy]
+	if !ok {
+		chk.add(location{entry: "use_proxy", line: chk.find("use_proxy")}, fmt.Errorf("proxy setting not found: %s", cfg.UseProxy))
+	}
+	r.Proxy = px
+	for name, p := range cfg.Proxies {
+		p.Name = name
+	}
+
+	// cfg.Reverse には "41000->example.com:8080" のような表記の文字列か [[reverse]] の表が格納されている
+	r.Timeouts = timeouts{cfg.IdleTimeout, cfg.MaxDuration, cfg.DialTimeout}.Timeouts()
+	ports := make(portTable)
+	sockets := make(socketTable)
+
+	// HTTP プロキシのポート番号は設定ファイルに無いため、他の設定の問題として報告されるよう最初に登録する
+	proxyPorts := location{entry: fmt.Sprintf("the HTTP proxy (-proxy_port %d, -ports %d)", proxyPort, numPorts)}
+	if numPorts < 1 || checkPort(proxyPort) != nil || checkPort(proxyPort+numPorts-1) != nil {
+		chk.add(proxyPorts, fmt.Errorf("ports out of range"))
+	} else {
+		for p := proxyPort; p < proxyPort+numPorts; p++ {
+			ports.add("", p, proxyPorts)
+		}
+	}
+
+	tables := decodeReverse(md, cfg.Reverse, cfg.ReverseOptions, chk)
+	r.Reverse = newReverses(tables, tomlfile, cfg.Proxies, px, r.Timeouts, ports, sockets, chk)
+
+	// HTTP プロキシは -proxy_port の他に Unix ソケットや特定のアドレスでも待ち受けられる
+	if r.HTTPSocket, err = parseSocketOptions(cfg.HTTP.SocketMode, cfg.HTTP.SocketOwner); err != nil {
+		chk.add(chk.table("http"), err)
+	}
+	for _, a := range cfg.HTTP.Listen {
+		loc := chk.value("http.listen", a)
+		if strings.HasPrefix(a, "unix:") {
+			a = "unix:" + relativePath(tomlfile, strings.TrimPrefix(a, "unix:"), "")
+			if err := sockets.add(strings.TrimPrefix(a, "unix:"), loc); err != nil {
+				chk.add(loc, err)
+				continue
+			}
+		} else {
+			host, port, err := net.SplitHostPort(a)
+			p, perr := strconv.Atoi(port)
+			if err == nil && perr != nil {
+				err = fmt.Errorf("invalid port in address %s", a)
+			}
+			if err == nil {
+				err = checkPort(p)
+			}
+			if err == nil {
+				err = ports.add(host, p, loc)
+			}
+			if err != nil {
+				chk.add(loc, err)
+				continue
+			}
 		}
+		r.HTTPListen = append(r.HTTPListen, a)
+	}
 
-		p, err := strconv.Atoi(kv[0])
+	r.SNIRoutes = make(map[int]*SNIRoute)
+	for p, hr := range parseRoutes("sni", cfg.SNI, "", chk) {
+		r.SNIRoutes[p] = &SNIRoute{Routes: hr.Routes, Default: hr.Default}
+		loc := chk.table("sni." + strconv.Itoa(p))
+		if err := ports.add("", p, loc); err != nil {
+			chk.add(loc, err)
+		}
+	}
+	r.VHosts = make(map[int]*VHostRoute)
+	for p, hr := range parseRoutes("vhost", cfg.VHost, "80", chk) {
+		r.VHosts[p] = &VHostRoute{Routes: hr.Routes, Default: hr.Default, RewriteHost: hr.RewriteHost}
+		loc := chk.table("vhost." + strconv.Itoa(p))
+		if err := ports.add("", p, loc); err != nil {
+			chk.add(loc, err)
+		}
+	}
+
+	r.Transport = Transport{
+		MaxIdleConnsPerHost:   cfg.Transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.Transport.IdleConnTimeout.Duration,
+		ResponseHeaderTimeout: cfg.Transport.ResponseHeaderTimeout.Duration,
+	}
+	if r.Transport.MaxIdleConnsPerHost == 0 {
+		r.Transport.MaxIdleConnsPerHost = DefaultTransport.MaxIdleConnsPerHost
+	}
+	if r.Transport.IdleConnTimeout == 0 {
+		r.Transport.IdleConnTimeout = DefaultTransport.IdleConnTimeout
+	}
+
+	fh := cfg.ForwardHeaders
+	r.ForwardHeaders = ForwardHeaders{
+		XForwardedFor: fh.XForwardedFor,
+		XRealIP:       fh.XRealIP,
+		Forwarded:     fh.Forwarded,
+		Via:           "proxy-relay",
+	}
+	if fh.Via != nil {
+		r.ForwardHeaders.Via = *fh.Via
+	}
+	for _, t := range fh.Trusted {
+		n, err := parseIPNet(t)
 		if err != nil {
-			return nil, fmt.Errorf("invalid portnumber: %v", err)
+			chk.add(chk.value("forward_headers.trusted", t), err)
+			continue
 		}
-		r.ReverseMap[p] = kv[1]
+		r.ForwardHeaders.Trusted = append(r.ForwardHeaders.Trusted, n)
 	}
 
-	px, ok := cfg.Proxies[cfg.UseProxy]
-	if !ok {
-		return nil, fmt.Errorf("proxy setting not found: %s", cfg.UseProxy)
+	for i, hr := range cfg.HeaderRules {
+		if hr.Host != "*" && strings.Contains(strings.TrimPrefix(hr.Host, "*."), "*") {
+			chk.add(chk.arrayTable("header_rules", i), fmt.Errorf("invalid host pattern: %s", hr.Host))
+		}
+	}
+	r.HeaderRules = cfg.HeaderRules
+
+	r.Hosts = newHosts(cfg.Hosts, chk)
+	for i, rr := range cfg.ResolveRules {
+		if rr.Host != "*" && strings.Contains(strings.TrimPrefix(rr.Host, "*."), "*") {
+			chk.add(chk.arrayTable("resolve_rules", i), fmt.Errorf("invalid host pattern: %s", rr.Host))
+		}
+	}
+	r.ResolveRules = cfg.ResolveRules
+
+	// 認証局のファイルは設定ファイルからの相対パスで指定する
+	r.MITM = MITM{
+		Hosts:  cfg.MITM.Hosts,
+		CACert: relativePath(tomlfile, cfg.MITM.CACert, "ca.pem"),
+		CAKey:  relativePath(tomlfile, cfg.MITM.CAKey, "ca-key.pem"),
+	}
+
+	// 一覧ファイルとテンプレートは設定ファイルからの相対パスで指定する
+	var files []string
+	for _, f := range cfg.Blocklist.Files {
+		files = append(files, relativePath(tomlfile, f, ""))
+	}
+	bl, err := newBlocklist(cfg.Blocklist.Exact, cfg.Blocklist.Suffix, cfg.Blocklist.Regex, files)
+	if err != nil {
+		chk.add(chk.table("blocklist"), err)
+	}
+	r.Blocklist = bl
+	if cfg.Blocklist.Page != "" {
+		r.BlockPage = relativePath(tomlfile, cfg.Blocklist.Page, "")
+	}
+
+	if cfg.Cache.Dir != "" {
+		r.Cache = Cache{
+			Dir:     relativePath(tomlfile, cfg.Cache.Dir, ""),
+			MaxSize: int64(cfg.Cache.MaxSize),
+		}
+		if r.Cache.MaxSize == 0 {
+			r.Cache.MaxSize = DefaultCacheSize
+		}
+	}
+
+	if cfg.DNS.Port != 0 {
+		loc := chk.table("dns")
+		r.DNS = DNS{
+			Port:         cfg.DNS.Port,
+			Server:       withDefaultPort(cfg.DNS.Server, "53"),
+			DirectServer: cfg.DNS.DirectServer,
+		}
+		if cfg.DNS.Server == "" {
+			chk.add(loc, fmt.Errorf("server is required"))
+		} else if err := checkAddr(r.DNS.Server); err != nil {
+			chk.add(loc, fmt.Errorf("server: %v", err))
+		}
+		if r.DNS.DirectServer != "" {
+			r.DNS.DirectServer = withDefaultPort(r.DNS.DirectServer, "53")
+			if err := checkAddr(r.DNS.DirectServer); err != nil {
+				chk.add(loc, fmt.Errorf("direct_server: %v", err))
+			}
+		}
+		if err := checkPort(r.DNS.Port); err != nil {
+			chk.add(loc, err)
+		} else if err := ports.add("", r.DNS.Port, loc); err != nil {
+			chk.add(loc, err)
+		}
+	}
+
+	r.Transparent = cfg.Transparent
+	if r.Transparent.Port != 0 {
+		loc := chk.table("transparent")
+		if err := checkPort(r.Transparent.Port); err != nil {
+			chk.add(loc, err)
+		} else if err := ports.add("", r.Transparent.Port, loc); err != nil {
+			chk.add(loc, err)
+		}
+	}
+	if err := chk.err(); err != nil {
+		return nil, err
 	}
-	r.Proxy = px
-	px.Name = cfg.UseProxy
 
 	r.DirectHosts = make(map[string]struct{})
 	for _, domain := range cfg.DirectHosts {
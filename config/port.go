@@ -0,0 +1,50 @@
+package config
+
+import "fmt"
+
+// portOwner はポート番号を待ち受ける設定。
+type portOwner struct {
+	host string   // 待ち受けるアドレス。空の場合は -bind で指定したアドレス。
+	loc  location // 設定項目とその位置。
+}
+
+// portTable は設定ごとに待ち受ける TCP のポート番号を記録し、重複を調べるための表。
+type portTable map[int][]portOwner
+
+// conflict は host:port で待ち受けた場合に重複する設定を返す。
+// どちらかがアドレスを指定していない場合は、同じポート番号なら重複とみなす。
+func (pt portTable) conflict(host string, port int) (portOwner, bool) {
+	for _, o := range pt[port] {
+		if o.host == "" || host == "" || o.host == host {
+			return o, true
+		}
+	}
+	return portOwner{}, false
+}
+
+// add は loc の設定が host:port で待ち受けることを記録する。既に他の設定が待ち受けている場合はエラーを返す。
+func (pt portTable) add(host string, port int, loc location) error {
+	if o, ok := pt.conflict(host, port); ok {
+		if o.loc.line > 0 {
+			return fmt.Errorf("port %d is also used by %s (line %d)", port, o.loc.entry, o.loc.line)
+		}
+		return fmt.Errorf("port %d is also used by %s", port, o.loc.entry)
+	}
+	pt[port] = append(pt[port], portOwner{host: host, loc: loc})
+	return nil
+}
+
+// socketTable は設定ごとに待ち受ける Unix ソケットのファイル名を記録し、重複を調べるための表。
+type socketTable map[string]location
+
+// add は loc の設定が path で待ち受けることを記録する。既に他の設定が待ち受けている場合はエラーを返す。
+func (st socketTable) add(path string, loc location) error {
+	if o, ok := st[path]; ok {
+		if o.line > 0 {
+			return fmt.Errorf("unix socket %s is also used by %s (line %d)", path, o.entry, o.line)
+		}
+		return fmt.Errorf("unix socket %s is also used by %s", path, o.entry)
+	}
+	st[path] = loc
+	return nil
+}
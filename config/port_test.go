@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPortTable(t *testing.T) {
+	pt := make(portTable)
+	if err := pt.add("127.0.0.1", 41000, location{entry: "a", line: 3}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		port int
+		want string // 空の場合は重複しない
+	}{
+		{"127.0.0.2", 41000, ""},
+		{"127.0.0.1", 41001, ""},
+		{"127.0.0.1", 41000, "port 41000 is also used by a (line 3)"},
+		{"", 41000, "port 41000 is also used by a (line 3)"},
+		{"", 41001, "port 41001 is also used by"},
+		{"::1", 41002, ""},
+	}
+	for _, tt := range tests {
+		err := pt.add(tt.host, tt.port, location{entry: tt.host})
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("add(%q, %d) = %v, want %q", tt.host, tt.port, err, tt.want)
+		}
+	}
+	// アドレスを指定しない設定は全てのアドレスと重複する
+	if err := pt.add("", 41002, location{entry: "b"}); err == nil {
+		t.Error("wildcard listener did not conflict with ::1")
+	}
+}
+
+func TestSocketTable(t *testing.T) {
+	st := make(socketTable)
+	if err := st.add("/run/a.sock", location{entry: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.add("/run/b.sock", location{entry: "b"}); err != nil {
+		t.Error(err)
+	}
+	if err := st.add("/run/a.sock", location{entry: "c"}); err == nil || err.Error() != "unix socket /run/a.sock is also used by a" {
+		t.Errorf("duplicate socket: got %v", err)
+	}
+}
+
+// TestProxyPorts は -proxy_port と -ports で指定した HTTP プロキシのポート番号と重複する設定が、
+// 設定ファイルの他の問題と共に設定項目の位置で報告されることを確かめる。
+func TestProxyPorts(t *testing.T) {
+	file := writeConfig(t, `reverse = ["41003->a.example:22"]
+[http]
+listen = ["127.0.0.1:41010", "unix:http.sock"]
+[sni.41020]
+default = "a.example:443"
+[dns]
+port = 41030`)
+	tests := []struct {
+		first, n int
+		want     []string // 行番号と問題
+	}{
+		{40000, 4, []string{"7: server is required"}},
+		{41000, 3, []string{"7: server is required"}},
+		{41000, 4, []string{
+			"2: port 41003 is also used by the HTTP proxy (-proxy_port 41000, -ports 4)",
+			"7: server is required",
+		}},
+		{41010, 11, []string{
+			"4: port 41010 is also used by the HTTP proxy (-proxy_port 41010, -ports 11)",
+			"5: port 41020 is also used by the HTTP proxy",
+			"7: server is required",
+		}},
+		{41030, 1, []string{"7: server is required", "7: port 41030 is also used by the HTTP proxy"}},
+		{65535, 2, []string{"7: server is required", "0: ports out of range"}},
+		{40000, 0, []string{"7: server is required", "0: ports out of range"}},
+	}
+	for _, tt := range tests {
+		_, err := New(file, tt.first, tt.n)
+		list := problemsOf(t, err)
+		if len(list) != len(tt.want) {
+			t.Errorf("New(%d, %d): got %d problems, want %d: %v", tt.first, tt.n, len(list), len(tt.want), err)
+			continue
+		}
+		for i, w := range tt.want {
+			if got := fmt.Sprintf("%d: %v", list[i].Line, list[i].Err); !strings.HasPrefix(got, w) {
+				t.Errorf("New(%d, %d): problem %d = %q, want %q", tt.first, tt.n, i, got, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ResolveMode は接続先のホスト名をどこで名前解決するかの設定。
+type ResolveMode int
+
+const (
+	ResolveRemote          ResolveMode = iota // ホスト名のまま上流へ渡し、上流の向こう側で解決する。
+	ResolveLocal                              // 手元で解決した IP アドレスを上流へ渡す。
+	ResolveLocalThenRemote                    // 手元で解決できればその IP アドレスを、できなければホスト名を上流へ渡す。
+)
+
+func (m *ResolveMode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "remote":
+		*m = ResolveRemote
+	case "local":
+		*m = ResolveLocal
+	case "local-then-remote":
+		*m = ResolveLocalThenRemote
+	default:
+		return fmt.Errorf("invalid resolve mode: %q (must be remote, local or local-then-remote)", text)
+	}
+	return nil
+}
+
+func (m ResolveMode) String() string {
+	switch m {
+	case ResolveLocal:
+		return "local"
+	case ResolveLocalThenRemote:
+		return "local-then-remote"
+	}
+	return "remote"
+}
+
+// ResolveRule は接続先ごとに名前解決の方法を変える規則。
+type ResolveRule struct {
+	Host    string      // 接続先のホスト名。MatchHost の形式。
+	Resolve ResolveMode // 名前解決の方法。
+}
+
+// newHosts は設定ファイルの [hosts] を検証し、ホスト名を小文字に揃えて返す。問題は chk に記録する。
+func newHosts(hosts map[string]string, chk *checker) map[string]net.IP {
+	r := make(map[string]net.IP, len(hosts))
+	for name, addr := range hosts {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			chk.add(location{entry: "hosts." + name, line: chk.find(strconv.Quote(addr))}, fmt.Errorf("invalid IP address: %s", addr))
+			continue
+		}
+		r[strings.ToLower(strings.TrimSuffix(name, "."))] = ip
+	}
+	return r
+}
@@ -0,0 +1,369 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Reverse はリバースプロキシ設定ひとつ分。
+type Reverse struct {
+	Host        string        // 待ち受けるアドレス。空の場合は proxy-relay の -addr で指定したアドレスを使う。
+	Port        int           // 待ち受けるポート番号。Unix ソケットの場合は 0。
+	Path        string        // 待ち受ける Unix ソケットのファイル名。TCP の場合は空。
+	Socket      SocketOptions // Unix ソケットのファイルの権限。
+	Target      string        // 接続先。"example.com:22" の形式か、上流を経由せずに繋ぐ手元の Unix ソケットの "unix:/path"。
+	Proto       string        // クライアントとの間のプロトコル。"tcp" か、TLS を終端する "tls"。
+	Upstream    *Proxy        // 経由するプロキシの設定。
+	Allow       []*net.IPNet  // 接続を許可するクライアントのアドレス。空の場合は全て許可する。
+	Timeouts    Timeouts      // 中継する接続の時間制限。全体の設定を反映済み。
+	MaxConns    int           // 同時に中継する接続の最大数。0 の場合は制限しない。
+	Description string        // ステータスページに表示する説明。
+	TLS         *ServerTLS    // Proto が "tls" の場合に TLS を終端する設定。
+	BackendTLS  *ClientTLS    // 接続先との間で TLS を開始する設定。接続先を "tls://" で指定した場合のみ。
+}
+
+// Listen は待ち受けるアドレスを "unix:/path" か "host:port" の形式で返す。host が空の場合は bind を使う。
+func (rv *Reverse) Listen(bind string) string {
+	if rv.Path != "" {
+		return "unix:" + rv.Path
+	}
+	host := rv.Host
+	if host == "" {
+		host = bind
+	}
+	return net.JoinHostPort(host, strconv.Itoa(rv.Port))
+}
+
+// reverseOptions は TOML 上のリバースプロキシ設定ごとのオプション。
+type reverseOptions struct {
+	IdleTimeout duration `toml:"idle_timeout"`
+	MaxDuration duration `toml:"max_duration"`
+	DialTimeout duration `toml:"dial_timeout"`
+	TLS         bool
+	Cert        string
+	Key         string
+	ClientCA    string `toml:"client_ca"`
+	ServerName  string `toml:"server_name"`
+	CA          string
+	ClientCert  string `toml:"client_cert"`
+	ClientKey   string `toml:"client_key"`
+}
+
+// reverseTable は TOML 上の [[reverse]] の表記。
+type reverseTable struct {
+	Listen      string
+	Target      string
+	Proto       string
+	Upstream    string
+	Allow       []string
+	MaxConns    int    `toml:"max_conns"`
+	SocketMode  string `toml:"socket_mode"`
+	SocketOwner string `toml:"socket_owner"`
+	Description string
+	reverseOptions
+	loc location // 設定ファイル上の位置。
+}
+
+// decodeReverse は "41000->example.com:8080" のような文字列の配列か [[reverse]] の表の配列を読み出す。
+// 文字列の配列の場合は範囲の指定を展開し、reverse_options の内容もここで反映する。問題は chk に記録する。
+func decodeReverse(md toml.MetaData, prim toml.Primitive, options map[string]reverseOptions, chk *checker) []reverseTable {
+	var mappings []string
+	if err := md.PrimitiveDecode(prim, &mappings); err != nil {
+		var tables []reverseTable
+		if err := md.PrimitiveDecode(prim, &tables); err != nil {
+			chk.add(location{entry: "reverse", line: chk.find("reverse")}, err)
+			return nil
+		}
+		for i := range tables {
+			tables[i].loc = chk.arrayTable("reverse", i)
+			if tables[i].Listen != "" {
+				tables[i].loc.entry += fmt.Sprintf(" (listen %q)", tables[i].Listen)
+			}
+		}
+		for key := range options {
+			chk.add(chk.table("reverse_options."+key), fmt.Errorf("reverse_options cannot be used with [[reverse]]; write the options in the [[reverse]] instead"))
+		}
+		return tables
+	}
+
+	var r []reverseTable
+	ports := make(map[int]int)
+	for _, mapping := range mappings {
+		loc := chk.value("reverse", mapping)
+		kv := strings.SplitN(mapping, "->", 2)
+		if len(kv) != 2 {
+			chk.add(loc, fmt.Errorf("could not parse mapping setting (must be \"port->host:port\")"))
+			continue
+		}
+		if _, _, err := parsePortRange(kv[0]); err != nil {
+			chk.add(loc, err)
+			continue
+		}
+		expanded, err := expandReverse(reverseTable{Listen: kv[0], Target: kv[1], loc: loc})
+		if err != nil {
+			chk.add(loc, err)
+			continue
+		}
+		for _, t := range expanded {
+			p, _ := strconv.Atoi(t.Listen)
+			ports[p] = len(r)
+			r = append(r, t)
+		}
+	}
+
+	// 時間制限などはリバースプロキシ設定ごとに上書きできる
+	for key, opt := range options {
+		loc := chk.table("reverse_options." + key)
+		p, err := strconv.Atoi(key)
+		if err != nil {
+			chk.add(loc, fmt.Errorf("invalid portnumber: %s", key))
+			continue
+		}
+		i, ok := ports[p]
+		if !ok {
+			chk.add(loc, fmt.Errorf("no such reverse mapping"))
+			continue
+		}
+		r[i].reverseOptions = opt
+	}
+	return r
+}
+
+// parsePortRange は "42000" または "42000-42009" の形式のポート番号の範囲を解釈する。
+func parsePortRange(s string) (first, last int, err error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	if first, err = strconv.Atoi(lo); err == nil {
+		last, err = strconv.Atoi(hi)
+	}
+	if err != nil || first > last {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	if err = checkPort(first); err == nil {
+		err = checkPort(last)
+	}
+	return first, last, err
+}
+
+// expandReverse は listen にポート番号の範囲を含む t をポート番号ごとの設定に展開する。
+// "42000-42009" を "db.internal:5432-5441" のような同じ長さの範囲に繋ぐ場合は順に対応させ、
+// "db.internal:5432" のようにひとつの接続先に繋ぐ場合は全て同じ接続先に繋ぐ。
+func expandReverse(t reverseTable) ([]reverseTable, error) {
+	if strings.HasPrefix(t.Listen, "unix:") || strings.HasPrefix(t.Listen, "/") {
+		return []reverseTable{t}, nil
+	}
+	host, lport := "", t.Listen
+	if h, p, err := net.SplitHostPort(t.Listen); err == nil {
+		host, lport = h, p
+	}
+	if !strings.Contains(lport, "-") {
+		return []reverseTable{t}, nil
+	}
+	first, last, err := parsePortRange(lport)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, target := "", t.Target
+	if strings.HasPrefix(target, "unix:") {
+		target = ""
+	} else if strings.HasPrefix(target, "tls://") {
+		scheme, target = "tls://", strings.TrimPrefix(target, "tls://")
+	}
+	thost, tport, tfirst, tlast := "", "", 0, 0
+	if target != "" {
+		if thost, tport, err = net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("invalid target: %v", err)
+		}
+		if tfirst, tlast, err = parsePortRange(tport); err != nil {
+			return nil, fmt.Errorf("invalid target: %v", err)
+		}
+	}
+	if tfirst != tlast && tlast-tfirst != last-first {
+		return nil, fmt.Errorf("port ranges differ in length: %s and %s", lport, tport)
+	}
+
+	r := make([]reverseTable, 0, last-first+1)
+	for i := 0; i <= last-first; i++ {
+		e := t
+		e.Listen = strconv.Itoa(first + i)
+		if host != "" {
+			e.Listen = net.JoinHostPort(host, e.Listen)
+		}
+		if target != "" {
+			p := tfirst
+			if tfirst != tlast {
+				p += i
+			}
+			e.Target = scheme + net.JoinHostPort(thost, strconv.Itoa(p))
+		}
+		r = append(r, e)
+	}
+	return r, nil
+}
+
+// newReverse は t を検証して Reverse に変換する。
+// upstream が空の場合は px を使い、時間制限の省略した項目は def を使う。
+func newReverse(t reverseTable, tomlfile string, proxies map[string]*Proxy, px *Proxy, def Timeouts) (*Reverse, error) {
+	rv := &Reverse{
+		Target:      t.Target,
+		Proto:       t.Proto,
+		Upstream:    px,
+		MaxConns:    t.MaxConns,
+		Description: t.Description,
+		Timeouts:    timeouts{t.IdleTimeout, t.MaxDuration, t.DialTimeout}.Timeouts().inherit(def),
+	}
+
+	// 待ち受けるアドレスは "41000"、"127.0.0.1:41000" または "unix:/path" の形式
+	switch {
+	case t.Listen == "":
+		return nil, fmt.Errorf("listen is required")
+	case strings.HasPrefix(t.Listen, "unix:"), strings.HasPrefix(t.Listen, "/"):
+		rv.Path = relativePath(tomlfile, strings.TrimPrefix(t.Listen, "unix:"), "")
+		opt, err := parseSocketOptions(t.SocketMode, t.SocketOwner)
+		if err != nil {
+			return nil, err
+		}
+		rv.Socket = opt
+	default:
+		port := t.Listen
+		if h, p, err := net.SplitHostPort(t.Listen); err == nil {
+			rv.Host, port = h, p
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address: %s", t.Listen)
+		}
+		if err := checkPort(p); err != nil {
+			return nil, err
+		}
+		rv.Port = p
+		if t.SocketMode != "" || t.SocketOwner != "" {
+			return nil, fmt.Errorf("socket_mode and socket_owner require a unix socket listener")
+		}
+	}
+
+	// 手元の Unix ソケットの接続先は設定ファイルからの相対パスで指定する
+	if strings.HasPrefix(rv.Target, "unix:") {
+		rv.Target = "unix:" + relativePath(tomlfile, strings.TrimPrefix(rv.Target, "unix:"), "")
+	} else {
+		rv.Target = strings.TrimPrefix(rv.Target, "tls://")
+		if err := checkAddr(rv.Target); err != nil {
+			return nil, fmt.Errorf("invalid target: %v", err)
+		}
+		if rv.Target != t.Target {
+			host, _, _ := net.SplitHostPort(rv.Target)
+			rv.BackendTLS = &ClientTLS{ServerName: host}
+		}
+	}
+
+	if t.Upstream != "" {
+		up, ok := proxies[t.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("proxy setting not found: %s", t.Upstream)
+		}
+		rv.Upstream = up
+	}
+	if rv.Path != "" && len(t.Allow) > 0 {
+		return nil, fmt.Errorf("allow cannot be used with a unix socket")
+	}
+	for _, a := range t.Allow {
+		n, err := parseIPNet(a)
+		if err != nil {
+			return nil, fmt.Errorf("allow: %v", err)
+		}
+		rv.Allow = append(rv.Allow, n)
+	}
+	if rv.MaxConns < 0 {
+		return nil, fmt.Errorf("invalid max_conns: %d", rv.MaxConns)
+	}
+
+	// 証明書のファイルは設定ファイルからの相対パスで指定する
+	switch rv.Proto {
+	case "", "tcp":
+		rv.Proto = "tcp"
+		if t.TLS {
+			rv.Proto = "tls"
+		}
+	case "tls":
+	default:
+		return nil, fmt.Errorf("invalid proto: %q (must be tcp or tls)", rv.Proto)
+	}
+	if rv.Proto == "tls" {
+		if (t.Cert == "") != (t.Key == "") {
+			return nil, fmt.Errorf("cert and key must be specified together")
+		}
+		rv.TLS = &ServerTLS{
+			CertFile: optionalPath(tomlfile, t.Cert),
+			KeyFile:  optionalPath(tomlfile, t.Key),
+			ClientCA: optionalPath(tomlfile, t.ClientCA),
+		}
+	}
+
+	if t.ServerName != "" || t.CA != "" || t.ClientCert != "" || t.ClientKey != "" {
+		if rv.BackendTLS == nil {
+			return nil, fmt.Errorf("server_name, ca, client_cert and client_key require a tls:// target")
+		}
+		if (t.ClientCert == "") != (t.ClientKey == "") {
+			return nil, fmt.Errorf("client_cert and client_key must be specified together")
+		}
+		if t.ServerName != "" {
+			rv.BackendTLS.ServerName = t.ServerName
+		}
+		rv.BackendTLS.CAFile = optionalPath(tomlfile, t.CA)
+		rv.BackendTLS.CertFile = optionalPath(tomlfile, t.ClientCert)
+		rv.BackendTLS.KeyFile = optionalPath(tomlfile, t.ClientKey)
+	}
+	return rv, nil
+}
+
+// newReverses は TOML 上のリバースプロキシ設定を全てポート番号ごとに展開して変換し、待ち受けるアドレスの順に並べて返す。
+// 待ち受けるポート番号は ports に、Unix ソケットは sockets に登録し、問題は chk に記録する。
+func newReverses(tables []reverseTable, tomlfile string, proxies map[string]*Proxy, px *Proxy, def Timeouts, ports portTable, sockets socketTable, chk *checker) []*Reverse {
+	var r []*Reverse
+	// 範囲の指定は同じ問題を何度も報告しないよう、最初の問題で打ち切る
+	// 文字列の配列の範囲は decodeReverse で展開済みのため、同じ設定項目から展開されたものも飛ばす
+	failed := make(map[location]bool)
+	for _, table := range tables {
+		if failed[table.loc] {
+			continue
+		}
+		expanded, err := expandReverse(table)
+		if err != nil {
+			chk.add(table.loc, err)
+			failed[table.loc] = true
+			continue
+		}
+		for _, t := range expanded {
+			rv, err := newReverse(t, tomlfile, proxies, px, def)
+			if err == nil && rv.Path != "" {
+				err = sockets.add(rv.Path, t.loc)
+			} else if err == nil {
+				err = ports.add(rv.Host, rv.Port, t.loc)
+			}
+			if err != nil {
+				chk.add(t.loc, err)
+				failed[t.loc] = true
+				break
+			}
+			r = append(r, rv)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Port != r[j].Port {
+			return r[i].Port < r[j].Port
+		}
+		if r[i].Host != r[j].Host {
+			return r[i].Host < r[j].Host
+		}
+		return r[i].Path < r[j].Path
+	})
+	return r
+}
@@ -0,0 +1,280 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig は use_proxy と上流のプロキシ設定の間に body を挟んだ設定ファイルを一時ディレクトリに書き込み、そのファイル名を返す。
+// body は設定ファイルの 2 行目から始まる。
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.toml")
+	toml := "use_proxy = \"p\"\n" + body + "\n[proxies.p]\nhost = \"127.0.0.1\"\nsocks_port = 1080\n"
+	if err := os.WriteFile(file, []byte(toml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// loadConfig は body の設定を HTTP プロキシが 40000 から 4 個のポート番号で待ち受けるものとして読み込む。
+func loadConfig(t *testing.T, body string) (*Config, error) {
+	t.Helper()
+	return New(writeConfig(t, body), 40000, 4)
+}
+
+// problemsOf は err が *Problems であればその一覧を返す。
+func problemsOf(t *testing.T, err error) []Problem {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var p *Problems
+	if !errors.As(err, &p) {
+		t.Fatalf("error is not *Problems: %v", err)
+	}
+	return p.List
+}
+
+// problemCase は設定に対して報告されるべき問題ひとつ分。
+type problemCase struct {
+	name string
+	body string
+	line int    // 問題の行番号
+	want string // エラーに含まれる文字列
+}
+
+// checkProblems は各 body の設定の問題がひとつだけで、期待する行番号とエラーであることを確かめる。
+func checkProblems(t *testing.T, tests []problemCase) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(t, tt.body)
+			list := problemsOf(t, err)
+			if len(list) != 1 {
+				t.Fatalf("got %d problems, want 1: %v", len(list), err)
+			}
+			if list[0].Line != tt.line || !strings.Contains(list[0].Err.Error(), tt.want) {
+				t.Errorf("got line %d %q, want line %d containing %q", list[0].Line, list[0].Err, tt.line, tt.want)
+			}
+		})
+	}
+}
+
+func TestReverseTable(t *testing.T) {
+	file := writeConfig(t, `
+[[reverse]]
+listen = "127.0.0.1:41000"
+target = "www.example.com:22"
+allow = ["192.168.0.0/16"]
+max_conns = 4
+[[reverse]]
+listen = "unix:ssh.sock"
+target = "unix:/run/app.sock"
+socket_mode = "0660"
+[[reverse]]
+listen = "41001"
+target = "tls://api.internal:443"
+server_name = "api.example.com"
+`)
+	cfg, err := New(file, 40000, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(file)
+	if len(cfg.Reverse) != 3 {
+		t.Fatalf("got %d reverse mappings, want 3", len(cfg.Reverse))
+	}
+
+	// 待ち受けるアドレスの順に並ぶため Unix ソケットが先頭になる
+	sock := cfg.Reverse[0]
+	if sock.Path != filepath.Join(dir, "ssh.sock") || sock.Port != 0 || sock.Listen("") != "unix:"+sock.Path {
+		t.Errorf("unix listener: got path %q port %d", sock.Path, sock.Port)
+	}
+	if sock.Socket.Mode != 0660 || sock.Socket.UID != -1 || sock.Socket.GID != -1 {
+		t.Errorf("unix listener: got socket options %+v", sock.Socket)
+	}
+	if sock.Target != "unix:/run/app.sock" {
+		t.Errorf("unix listener: got target %q", sock.Target)
+	}
+
+	rv := cfg.Reverse[1]
+	if rv.Host != "127.0.0.1" || rv.Port != 41000 || rv.Target != "www.example.com:22" || rv.MaxConns != 4 || len(rv.Allow) != 1 {
+		t.Errorf("tcp listener: got %+v", rv)
+	}
+	if rv.Proto != "tcp" || rv.Upstream == nil || rv.Upstream.Name != "p" {
+		t.Errorf("tcp listener: got proto %q upstream %+v", rv.Proto, rv.Upstream)
+	}
+
+	tls := cfg.Reverse[2]
+	if tls.Host != "" || tls.Port != 41001 || tls.Target != "api.internal:443" {
+		t.Errorf("tls target: got %+v", tls)
+	}
+	if tls.BackendTLS == nil || tls.BackendTLS.ServerName != "api.example.com" {
+		t.Errorf("tls target: got backend TLS %+v", tls.BackendTLS)
+	}
+}
+
+func TestReverseProblems(t *testing.T) {
+	checkProblems(t, []problemCase{
+		{
+			name: "legacy listen out of range",
+			body: `reverse = ["70000->a.example:22"]`,
+			line: 2, want: "port number out of range: 70000",
+		},
+		{
+			name: "legacy target out of range",
+			body: `reverse = ["41000->a.example:0"]`,
+			line: 2, want: "port number out of range: 0",
+		},
+		{
+			name: "table listen out of range",
+			body: "[[reverse]]\nlisten = \"127.0.0.1:65536\"\ntarget = \"a.example:22\"",
+			line: 2, want: "port number out of range: 65536",
+		},
+		{
+			name: "legacy duplicate",
+			body: "reverse = [\n  \"41000->a.example:22\",\n  \"41000->b.example:22\",\n]",
+			line: 4, want: `port 41000 is also used by reverse "41000->a.example:22" (line 3)`,
+		},
+		{
+			name: "table duplicate with and without address",
+			body: "[[reverse]]\nlisten = \"41000\"\ntarget = \"a.example:22\"\n[[reverse]]\nlisten = \"127.0.0.1:41000\"\ntarget = \"b.example:22\"",
+			line: 5, want: "port 41000 is also used by [[reverse]] #1",
+		},
+		{
+			name: "table duplicate unix socket",
+			body: "[[reverse]]\nlisten = \"unix:a.sock\"\ntarget = \"a.example:22\"\n[[reverse]]\nlisten = \"unix:a.sock\"\ntarget = \"b.example:22\"",
+			line: 5, want: "is also used by [[reverse]] #1",
+		},
+		{
+			name: "reverse_options with tables",
+			body: "[[reverse]]\nlisten = \"41000\"\ntarget = \"a.example:22\"\n[reverse_options.41000]\nidle_timeout = \"1h\"",
+			line: 5, want: "reverse_options cannot be used with [[reverse]]",
+		},
+		{
+			name: "reverse_options without mapping",
+			body: "reverse = [\"41000->a.example:22\"]\n[reverse_options.41001]\nidle_timeout = \"1h\"",
+			line: 3, want: "no such reverse mapping",
+		},
+		{
+			name: "allow on unix socket",
+			body: "[[reverse]]\nlisten = \"unix:a.sock\"\ntarget = \"a.example:22\"\nallow = [\"127.0.0.1\"]",
+			line: 2, want: "allow cannot be used with a unix socket",
+		},
+		{
+			name: "socket_mode on tcp",
+			body: "[[reverse]]\nlisten = \"41000\"\ntarget = \"a.example:22\"\nsocket_mode = \"0660\"",
+			line: 2, want: "socket_mode and socket_owner require a unix socket listener",
+		},
+		{
+			name: "unknown upstream",
+			body: "[[reverse]]\nlisten = \"41000\"\ntarget = \"a.example:22\"\nupstream = \"nope\"",
+			line: 2, want: "proxy setting not found: nope",
+		},
+	})
+}
+
+func TestReverseRange(t *testing.T) {
+	type mapping struct {
+		listen, target string
+		tls            bool
+	}
+	check := func(t *testing.T, cfg *Config, want []mapping) {
+		t.Helper()
+		if len(cfg.Reverse) != len(want) {
+			t.Fatalf("got %d reverse mappings, want %d", len(cfg.Reverse), len(want))
+		}
+		for i, w := range want {
+			rv := cfg.Reverse[i]
+			if rv.Listen("0.0.0.0") != w.listen || rv.Target != w.target || (rv.BackendTLS != nil) != w.tls {
+				t.Errorf("mapping %d: got %s -> %s (backend TLS %v), want %s -> %s (%v)", i, rv.Listen("0.0.0.0"), rv.Target, rv.BackendTLS != nil, w.listen, w.target, w.tls)
+			}
+		}
+	}
+
+	cfg, err := loadConfig(t, `reverse = [
+  "42000-42002->db.internal:5432-5434",
+  "42100-42101->tls://api.internal:443",
+]
+[reverse_options.42001]
+idle_timeout = "2h"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, cfg, []mapping{
+		{"0.0.0.0:42000", "db.internal:5432", false},
+		{"0.0.0.0:42001", "db.internal:5433", false},
+		{"0.0.0.0:42002", "db.internal:5434", false},
+		{"0.0.0.0:42100", "api.internal:443", true},
+		{"0.0.0.0:42101", "api.internal:443", true},
+	})
+	// reverse_options は範囲の中のポート番号ひとつだけに適用される
+	if cfg.Reverse[1].Timeouts.Idle.Hours() != 2 || cfg.Reverse[0].Timeouts.Idle != 0 || cfg.Reverse[2].Timeouts.Idle != 0 {
+		t.Errorf("idle timeouts = %v %v %v, want 0 2h 0", cfg.Reverse[0].Timeouts.Idle, cfg.Reverse[1].Timeouts.Idle, cfg.Reverse[2].Timeouts.Idle)
+	}
+
+	// [[reverse]] ではアドレスを付けた範囲も書ける
+	cfg, err = loadConfig(t, `
+[[reverse]]
+listen = "127.0.0.1:42300-42301"
+target = "tls://api.internal:8443-8444"
+[[reverse]]
+listen = "42400-42401"
+target = "unix:/run/app.sock"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, cfg, []mapping{
+		{"127.0.0.1:42300", "api.internal:8443", true},
+		{"127.0.0.1:42301", "api.internal:8444", true},
+		{"0.0.0.0:42400", "unix:/run/app.sock", false},
+		{"0.0.0.0:42401", "unix:/run/app.sock", false},
+	})
+}
+
+func TestReverseRangeProblems(t *testing.T) {
+	checkProblems(t, []problemCase{
+		{
+			name: "length mismatch",
+			body: `reverse = ["42000-42002->db.internal:5432-5433"]`,
+			line: 2, want: "port ranges differ in length: 42000-42002 and 5432-5433",
+		},
+		{
+			name: "table length mismatch",
+			body: "[[reverse]]\nlisten = \"42000-42002\"\ntarget = \"db.internal:5432-5440\"",
+			line: 2, want: "port ranges differ in length",
+		},
+		{
+			name: "reversed range",
+			body: `reverse = ["42009-42000->db.internal:5432"]`,
+			line: 2, want: "invalid port range: 42009-42000",
+		},
+		{
+			name: "range out of range",
+			body: `reverse = ["65530-65540->db.internal:5432"]`,
+			line: 2, want: "port number out of range: 65540",
+		},
+		{
+			name: "target range out of range",
+			body: `reverse = ["42000-42001->db.internal:65535-65536"]`,
+			line: 2, want: "port number out of range: 65536",
+		},
+		{
+			// 重なるポート番号が複数あっても範囲ごとに一度だけ報告する
+			name: "overlapping ranges",
+			body: "reverse = [\n  \"42000-42009->a.example:22\",\n  \"42005-42014->b.example:22\",\n]",
+			line: 4, want: `port 42005 is also used by reverse "42000-42009->a.example:22" (line 3)`,
+		},
+		{
+			name: "range overlaps single port",
+			body: "[[reverse]]\nlisten = \"42003\"\ntarget = \"a.example:22\"\n[[reverse]]\nlisten = \"42000-42009\"\ntarget = \"b.example:22\"",
+			line: 5, want: "port 42003 is also used by [[reverse]] #1",
+		},
+	})
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SNIRoute は TLS の ClientHello の SNI を見て接続先を選ぶリバースプロキシの設定。TLS は終端しない。
+type SNIRoute struct {
+	Routes  map[string]string // SNI のホスト名ごとの接続先。"*.example.com" のようにサブドメインも指定できる。ホスト名は小文字。
+	Default string            // どれにも一致しない場合や SNI が無い場合の接続先。空の場合は接続を閉じる。
+}
+
+// Target は SNI が host の接続の接続先を返す。
+func (r *SNIRoute) Target(host string) string {
+	return routeTarget(r.Routes, r.Default, host)
+}
+
+// VHostRoute は HTTP の Host ヘッダを見てリクエストごとに接続先を選ぶリバースプロキシの設定。
+type VHostRoute struct {
+	Routes      map[string]string // Host ヘッダのホスト名ごとの接続先。"*.example.com" のようにサブドメインも指定できる。ホスト名は小文字。
+	Default     string            // どれにも一致しない場合の接続先。空の場合は 502 を返す。
+	RewriteHost bool              // 接続先へ送る Host ヘッダを接続先のホスト名に書き換えるかどうか。
+}
+
+// Target は Host ヘッダのホスト名が host のリクエストの接続先を返す。
+func (r *VHostRoute) Target(host string) string {
+	return routeTarget(r.Routes, r.Default, host)
+}
+
+// routeTarget は routes から host の接続先を選ぶ。完全に一致するものを優先し、次に最も長いサブドメインの指定を使い、
+// どれにも一致しなければ def を返す。
+func routeTarget(routes map[string]string, def, host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if t, ok := routes[host]; ok {
+		return t
+	}
+	var best, target string
+	for p, t := range routes {
+		if strings.HasPrefix(p, "*.") && len(p) > len(best) && MatchHost(p, host) {
+			best, target = p, t
+		}
+	}
+	if best != "" {
+		return target
+	}
+	return def
+}
+
+// hostRoute は TOML 上の SNIRoute と VHostRoute の設定。
+type hostRoute struct {
+	Default     string
+	Routes      map[string]string
+	RewriteHost bool `toml:"rewrite_host"`
+}
+
+// parseRoutes は section (sni や vhost) の各ポートの設定を検証し、ホスト名を小文字に揃える。
+// defaultPort が空でなければ、ポート番号を省略した接続先にそれを補う。問題は chk に記録し、その設定は読み飛ばす。
+func parseRoutes(section string, cfg map[string]hostRoute, defaultPort string, chk *checker) map[int]hostRoute {
+	r := make(map[int]hostRoute)
+	for key, hr := range cfg {
+		loc := chk.table(section + "." + key)
+		p, err := strconv.Atoi(key)
+		if err == nil {
+			err = checkPort(p)
+		}
+		if err != nil {
+			chk.add(loc, fmt.Errorf("invalid portnumber: %s", key))
+			continue
+		}
+		ok := true
+		check := func(name, target string) string {
+			if defaultPort != "" {
+				target = withDefaultPort(target, defaultPort)
+			}
+			if err := checkAddr(target); err != nil {
+				chk.add(loc, fmt.Errorf("%s: %v", name, err))
+				ok = false
+			}
+			return target
+		}
+		route := hostRoute{Routes: make(map[string]string), RewriteHost: hr.RewriteHost}
+		if hr.Default != "" {
+			route.Default = check("default", hr.Default)
+		}
+		for host, target := range hr.Routes {
+			if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				chk.add(loc, fmt.Errorf("routes: invalid host pattern: %s", host))
+				ok = false
+				continue
+			}
+			route.Routes[strings.ToLower(host)] = check("routes."+host, target)
+		}
+		if ok {
+			r[p] = route
+		}
+	}
+	return r
+}
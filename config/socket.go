@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// SocketOptions は Unix ソケットで待ち受ける際のファイルの権限の設定。
+type SocketOptions struct {
+	Mode os.FileMode // ファイルのパーミッション。0 の場合は変更しない。
+	UID  int         // ファイルの所有者。-1 の場合は変更しない。
+	GID  int         // ファイルのグループ。-1 の場合は変更しない。
+}
+
+// parseSocketOptions は "0660" のような 8 進数のパーミッションと、"user"、"user:group"、":group" のような所有者を解釈する。
+// ユーザー名やグループ名の代わりに数値の ID も使える。
+func parseSocketOptions(mode, owner string) (SocketOptions, error) {
+	opt := SocketOptions{UID: -1, GID: -1}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return opt, fmt.Errorf("invalid socket_mode: %q (must be octal like \"0660\")", mode)
+		}
+		opt.Mode = os.FileMode(m)
+	}
+	if owner == "" {
+		return opt, nil
+	}
+
+	name, group := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+	if name != "" {
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return opt, fmt.Errorf("socket_owner: %v", err)
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		opt.UID = id
+	}
+	if group != "" {
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return opt, fmt.Errorf("socket_owner: %v", err)
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		opt.GID = id
+	}
+	return opt, nil
+}
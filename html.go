@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 )
 
 const htmlTemplate = `
@@ -19,6 +21,7 @@ const htmlTemplate = `
     <h1>プロキシについて</h1>
 
     <p>このプロキシを使うには、自動構成スクリプトとして <a href="http://{{.IPAddress}}:{{.Port}}/proxy.pac" target="_blank">http://{{.IPAddress}}:{{.Port}}/proxy.pac</a> を登録してください。</p>
+    {{with .Config.HTTPListen}}<p>以下のアドレスでも HTTP プロキシとして待ち受けています: {{range .}}<code>{{.}}</code> {{end}}</p>{{end}}
     <p><button type="button" class="btn btn-primary" onclick="location.href='/reload';return false">設定をリロード</button></p>
 
     <h2>現在使用しているプロキシ</h2>
@@ -46,8 +49,107 @@ const htmlTemplate = `
           <th>パスワード</th>
           <td>{{.Config.Proxy.Password}}</td>
         </tr>
+        <tr>
+          <th>名前解決</th>
+          <td>{{.Config.Proxy.Resolve}}</td>
+        </tr>
+      </tbody>
+    </table>
+
+    {{with .Upstream}}
+    <h2>上流への接続</h2>
+    <p>HTTP プロキシとして中継するリクエストは全てのポートで以下の接続を共有しています。</p>
+    {{with .Stats}}
+    <table class="table table-bordered">
+      <tbody>
+        <tr>
+          <th>接続数</th>
+          <td>{{.Open}} <small class="text-muted">(使用中 {{.Active}} / 待機中 {{.Idle}})</small></td>
+        </tr>
+        <tr>
+          <th>リクエスト数</th>
+          <td>{{.Requests}} <small class="text-muted">(接続を再利用 {{.Reused}} / 新規接続 {{.Dials}})</small></td>
+        </tr>
+      </tbody>
+    </table>
+    {{end}}
+    {{end}}
+
+    {{if .Config.MITM.Hosts}}
+    <h2>TLS の検査</h2>
+    <p>以下のホストへの HTTPS 通信は proxy-relay で TLS を終端して中継します。
+    ブラウザなどに <a href="/ca.pem">認証局の証明書</a> をインストールしてください。</p>
+    <ul>
+      {{range .Config.MITM.Hosts}}
+        <li>{{.}}</li>
+      {{end}}
+    </ul>
+    {{end}}
+
+    {{with .Blocker}}
+    <h2>接続の拒否</h2>
+    <p>{{.Len}} 件の規則に一致する接続先へのリクエストを拒否しています。設定の再読み込み後に拒否したリクエストは {{.Hits}} 件です。</p>
+    {{end}}
+
+    {{with .Cache}}
+    <h2>キャッシュ</h2>
+    {{with .Stats}}
+    <table class="table table-bordered">
+      <tbody>
+        <tr>
+          <th>保存数</th>
+          <td>{{.Entries}} <small class="text-muted">({{.Size}} / {{.MaxSize}} バイト)</small></td>
+        </tr>
+        <tr>
+          <th>リクエスト数</th>
+          <td>キャッシュから返却 {{.Hits}} / 確認して返却 {{.Revalidated}} / 上流から取得 {{.Misses}}</td>
+        </tr>
+      </tbody>
+    </table>
+    {{end}}
+    <form class="form-inline" method="post" action="/cache/purge">
+      <input type="text" class="form-control" name="url" placeholder="http://www.example.com/">
+      <button type="submit" class="btn btn-default">URL のキャッシュを削除</button>
+    </form>
+    <form class="form-inline" method="post" action="/cache/purge">
+      <input type="text" class="form-control" name="host" placeholder="www.example.com">
+      <button type="submit" class="btn btn-default">ホストのキャッシュを削除</button>
+    </form>
+    {{end}}
+
+    {{if .Config.Transparent.Port}}
+    <h2>透過プロキシ</h2>
+    <p>{{.Config.Transparent.Port}} 番ポートに REDIRECT された接続を本来の接続先へ中継しています。
+    {{if .Config.Transparent.Sniff}}TLS の SNI や HTTP の Host ヘッダからホスト名を読み取ります。{{end}}</p>
+    <pre>iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner proxy-relay -j REDIRECT --to-ports {{.Config.Transparent.Port}}</pre>
+    {{end}}
+
+    {{if .Config.DNS.Port}}
+    <h2>DNS</h2>
+    <p>{{.IPAddress}}:{{.Config.DNS.Port}} で受け付けた DNS の問い合わせをプロキシを経由して {{.Config.DNS.Server}} に転送しています。
+    プロキシ除外設定のドメインは {{or .Config.DNS.DirectServer "システムの DNS サーバ"}} に問い合わせます。</p>
+    {{end}}
+
+    {{if or .Config.Hosts .Config.ResolveRules}}
+    <h2>名前解決</h2>
+    <p>以下のホストへの接続はホスト名を置き換えてから上流へ渡します。</p>
+    <table class="table table-bordered">
+      <tbody>
+        {{range $k, $v := .Config.Hosts}}
+          <tr>
+            <td>{{$k}}</td>
+            <td>{{$v}}</td>
+          </tr>
+        {{end}}
+        {{range .Config.ResolveRules}}
+          <tr>
+            <td>{{.Host}}</td>
+            <td>{{.Resolve}}</td>
+          </tr>
+        {{end}}
       </tbody>
     </table>
+    {{end}}
 
     <h2>リバースプロキシマッピング</h2>
     <p>マップ元に接続するとプロキシ設定なしで直接目的の場所に接続できます。</p>
@@ -55,24 +157,56 @@ const htmlTemplate = `
       <thead>
         <tr>
           <th>マップ元</th>
+          <th>プロトコル</th>
           <th>接続先</th>
+          <th>経由するプロキシ</th>
+          <th>接続を許可するアドレス</th>
+          <th>最大接続数</th>
+          <th>時間制限</th>
+          <th>説明</th>
         </tr>
       </thead>
       <tbody>
         {{$ipaddr := .IPAddress}}
-        {{range $k, $v := .Config.ReverseMap}}
+        {{range .Config.Reverse}}
           <tr>
-            <td>{{$ipaddr}}:{{$k}}</td>
-            <td>{{$v}}</td>
+            <td>{{if .Path}}unix:{{.Path}}{{else}}{{or .Host $ipaddr}}:{{.Port}}{{end}}</td>
+            <td>{{.Proto}}{{with .TLS}}{{if .ClientCA}} <small class="text-muted">(クライアント証明書)</small>{{end}}{{end}}</td>
+            <td>{{if .BackendTLS}}tls://{{end}}{{.Target}}</td>
+            <td>{{if hasPrefix .Target "unix:"}}<small class="text-muted">(直接)</small>{{else}}{{.Upstream.Name}}{{end}}</td>
+            <td>{{range .Allow}}{{.}}<br>{{else}}<small class="text-muted">(制限なし)</small>{{end}}</td>
+            <td>{{if .MaxConns}}{{.MaxConns}}{{else}}<small class="text-muted">(制限なし)</small>{{end}}</td>
+            <td>
+              {{with .Timeouts}}
+              idle_timeout: {{if .Idle}}{{.Idle}}{{else}}<small class="text-muted">(制限なし)</small>{{end}}<br>
+              max_duration: {{if .MaxDuration}}{{.MaxDuration}}{{else}}<small class="text-muted">(制限なし)</small>{{end}}<br>
+              dial_timeout: {{if .Dial}}{{.Dial}}{{else}}<small class="text-muted">(制限なし)</small>{{end}}
+              {{end}}
+            </td>
+            <td>{{.Description}}</td>
           </tr>
         {{else}}
           <tr>
-            <td colspan="2">現在有効なマッピング設定はありません。</td>
+            <td colspan="9">現在有効なマッピング設定はありません。</td>
           </tr>
         {{end}}
       </tbody>
     </table>
 
+    {{if .Config.SNIRoutes}}
+    <h2>SNI による振り分け</h2>
+    <p>以下のポートへの HTTPS の接続は SNI のホスト名で接続先を選びます。
+    使用するにはクライアントの /etc/hosts に以下のような行を追加し、https://ホスト名:ポート番号/ に接続してください。</p>
+    {{template "hostRoutes" (hostRoutes $ipaddr .Config.SNIRoutes)}}
+    {{end}}
+
+    {{if .Config.VHosts}}
+    <h2>Host ヘッダによる振り分け</h2>
+    <p>以下のポートへの HTTP のリクエストは Host ヘッダのホスト名で接続先を選びます。
+    使用するにはクライアントの /etc/hosts に以下のような行を追加し、http://ホスト名:ポート番号/ に接続してください。</p>
+    {{template "hostRoutes" (hostRoutes $ipaddr .Config.VHosts)}}
+    {{end}}
+
     <h2>プロキシ除外設定</h2>
     <p>以下のドメインに対する接続はプロキシを経由せず直接接続します。</p>
     <ul>
@@ -83,17 +217,64 @@ const htmlTemplate = `
   </div>
 </body>
 </html>
-`
+
+{{define "hostRoutes"}}{{$ipaddr := .IPAddress}}
+    {{range $port, $route := .Routes}}
+    <h3>{{$ipaddr}}:{{$port}}</h3>
+    <table class="table table-bordered table-hover">
+      <thead>
+        <tr>
+          <th>ホスト名</th>
+          <th>接続先</th>
+        </tr>
+      </thead>
+      <tbody>
+        {{range $host, $target := $route.Routes}}
+          <tr>
+            <td>{{$host}}</td>
+            <td>{{$target}}</td>
+          </tr>
+        {{end}}
+        {{with $route.Default}}
+          <tr>
+            <td><small class="text-muted">(その他)</small></td>
+            <td>{{.}}</td>
+          </tr>
+        {{end}}
+      </tbody>
+    </table>
+    <pre>{{range $host, $target := $route.Routes}}{{if not (hasPrefix $host "*.")}}{{$ipaddr}} {{$host}}
+{{end}}{{end}}</pre>
+    {{if hasWildcard $route.Routes}}
+    <p><small class="text-muted">"*." で始まるホスト名は /etc/hosts に書けないため、個々のホスト名を追加してください。</small></p>
+    {{end}}
+    {{end}}
+{{end}}`
+
+// htmlTpl は htmlTemplate を解析したもの。
+// hostRoutes は SNI と Host ヘッダによる振り分けのポートごとの一覧 routes を、表示するアドレスと共に "hostRoutes" に渡す。
+var htmlTpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"hasPrefix": strings.HasPrefix,
+	"hostRoutes": func(ipaddr string, routes interface{}) map[string]interface{} {
+		return map[string]interface{}{"IPAddress": ipaddr, "Routes": routes}
+	},
+	"hasWildcard": func(routes map[string]string) bool {
+		for host := range routes {
+			if strings.HasPrefix(host, "*.") {
+				return true
+			}
+		}
+		return false
+	},
+}).Parse(htmlTemplate))
 
 // serveStat はプロキシサーバの設定情報を Web ページとして返す。
 func (rl *relay) serveStat(w http.ResponseWriter, r *http.Request) {
-	tpl, err := template.New("").Parse(htmlTemplate)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	err = tpl.Execute(w, map[string]interface{}{
+	err := htmlTpl.Execute(w, map[string]interface{}{
 		"Config":    rl.cfg,
+		"Upstream":  rl.upstream,
+		"Blocker":   rl.blocker,
+		"Cache":     rl.cache,
 		"IPAddress": rl.address,
 		"Port":      rl.port,
 	})
@@ -112,3 +293,39 @@ func (rl *relay) serveReload(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "close")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// serveCA は TLS を終端する際に使用する認証局の証明書を返す。
+func (rl *relay) serveCA(w http.ResponseWriter, r *http.Request) {
+	if rl.ca == nil || len(rl.cfg.MITM.Hosts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="proxy-relay-ca.pem"`)
+	w.Write(rl.ca.CertPEM())
+}
+
+// serveCachePurge は POST された url または host に一致するレスポンスをキャッシュから削除する。
+func (rl *relay) serveCachePurge(w http.ResponseWriter, r *http.Request) {
+	if rl.cache == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var n int
+	switch {
+	case r.FormValue("url") != "":
+		n = rl.cache.PurgeURL(r.FormValue("url"))
+	case r.FormValue("host") != "":
+		n = rl.cache.PurgeHost(r.FormValue("host"))
+	default:
+		http.Error(w, "url or host is required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "purged %d entries\n", n)
+}
@@ -18,6 +18,10 @@ Usage
 起動例は以下の通り。
 
 	proxy-relay [flag]
+	proxy-relay [flag] check
+
+check を付けると設定ファイルを検証して問題を行番号と共に全て出力し、問題があれば終了コード 1 で終了します。
+待ち受けるポート番号の重複なども含め、起動時や再読み込み時にも同じ検証を行います。
 
 flag には以下のようなものを指定できます。
 
@@ -34,6 +38,9 @@ flag には以下のようなものを指定できます。
 		別のマシンからのアクセスを許容する場合には -addr="192.168.1.12" などに変更する必要があります。
 	-bind=""
 		待ち受ける際にバインドするアドレスを指定します。
+	-grace=10s
+		終了時に処理中のリクエストやトンネルの完了を待つ最大時間です。
+		この時間を過ぎても残っている接続は強制的に切断されます。
 	-v
 		詳細なログを出力します。
 
@@ -42,6 +49,16 @@ Configuration
 設定ファイル config.toml には、TOML ファイルの書式で動作に関わる様々な設定を記述できます。
 
 proxy-relay の実行中にこのファイルが編集された場合などには約1秒後に自動的に設定が再読み込みされます。
+SIGHUP を受け取った場合も設定を再読み込みします。
+
+SIGTERM または SIGINT を受け取ると新しい接続の受付を止め、処理中の接続が終わるのを -grace で指定した時間まで待ってから終了します。
+待機中にもう一度シグナルを受け取った場合は即座に終了します。
+
+SIGUSR2 を受け取ると実行ファイルを同じ引数で起動し直し、待ち受けている全てのソケットを新しいプロセスに引き継ぎます。
+新しいプロセスの起動が完了したら、元のプロセスは新しい接続の受付を止め、処理中の接続やトンネルが終わるのを -grace で指定した時間まで待ってから終了します。
+実行ファイルを置き換えてから SIGUSR2 を送れば、接続を切らずにバージョンを上げられます。
+新しいプロセスが設定ファイルの誤りなどで起動できなかった場合は、元のプロセスがそのまま動作を続けます。
+Windows には SIGUSR2 が無いため、この引き継ぎは使えません。
 
 	# 使用するプロキシの設定名です。
 	# [proxies.xxxxxxx] の中から使用する設定をひとつ選びます。
@@ -52,9 +69,14 @@ proxy-relay の実行中にこのファイルが編集された場合などに
 	# 例えば上記設定をした上で (-addr で指定したホスト):41000 に接続すると、
 	# proxy-relay が use_proxy で指定したプロキシ設定の host:socks_port に SOCKSv5 で接続し、
 	# そこで www.example.com:22 への接続を要求します。
+	# "42000-42009->db.internal:5432-5441" のように範囲で書くと 42000 を 5432 に、42001 を 5433 に…と順に対応させ、
+	# "42100-42103->db.internal:5432" のように接続先をひとつにすると全て同じ接続先に繋ぎます。
+	# 待ち受けるポート番号が -proxy_port と -ports の範囲や他の設定と重複している場合はエラーになります。
 	reverse = [
 	  "41000->www.example.com:22",
 	  "41001->images.example.com:22",
+	  "41010->tls://api.internal:443",
+	  "42000-42009->db.internal:5432-5441",
 	]
 
 	# プロキシ除外設定
@@ -68,6 +90,195 @@ proxy-relay の実行中にこのファイルが編集された場合などに
 	  "api.bootswatch.com",
 	]
 
+	# 中継する接続の時間制限です。"30s" や "5m" のように記述し、省略した場合は制限しません。
+	# idle_timeout はどちらの方向にも通信が無い状態が続いた場合、max_duration は接続してからの経過時間、
+	# dial_timeout はプロキシを経由して接続先に繋ぐまでの時間の上限です。
+	idle_timeout = "30m"
+	max_duration = "24h"
+	dial_timeout = "30s"
+
+	# リバースプロキシごとに時間制限を上書きできます。省略した項目は全体の設定が使用されます。
+	[reverse_options.41000]
+	idle_timeout = "2h"
+
+	# tls を true にするとクライアントとの TLS を終端し、復号したデータを接続先へそのまま送ります。
+	# cert と key を省略した場合は自己署名の証明書を使います。
+	# client_ca を指定するとその認証局が発行したクライアント証明書を持つクライアントだけが接続できます。
+	[reverse_options.41001]
+	tls = true
+	cert = "server.pem"
+	key = "server-key.pem"
+	client_ca = "team-ca.pem"
+
+	# 接続先を "41010->tls://api.internal:443" のように tls:// を付けて書くと、クライアントとは平文のまま、
+	# 上流の SOCKS プロキシで繋いだ接続先との間で TLS を開始します。
+	# TLS を話せない古いツールから HTTPS のみのサービスに繋ぐ際に使います。
+	# server_name で SNI と証明書の検証に使うホスト名を、ca で接続先の証明書を検証する認証局を指定できます
+	# (ca を指定した場合はその認証局だけを信頼します)。client_cert と client_key を指定するとクライアント証明書を提示します。
+	[reverse_options.41010]
+	server_name = "api.example.com"
+	ca = "internal-ca.pem"
+	client_cert = "client.pem"
+	client_key = "client-key.pem"
+
+	# リバースプロキシは reverse と reverse_options の代わりに [[reverse]] の表でも記述できます (両方の形式は混在できません)。
+	# listen には "41000"、"127.0.0.1:41000"、"42000-42009" のような待ち受けるアドレスか "unix:/run/proxy-relay/ssh.sock" のような
+	# Unix ソケットのファイル名を、target には上記の接続先を指定します。proto を "tls" にすると tls = true と同じく TLS を終端します。
+	# upstream を指定すると use_proxy の代わりにそのプロキシ設定を経由し、allow を指定するとそのアドレスからの接続だけを受け付けます。
+	# max_conns は同時に中継する接続の最大数、description はステータスページに表示する説明です。
+	# Unix ソケットで待ち受ける場合は socket_mode ("0660" のような 8 進数) と socket_owner ("user:group") でファイルの権限を設定できます。
+	# target を "unix:/run/app/app.sock" のようにすると、上流のプロキシを経由せずに手元の Unix ソケットに繋ぎます。
+	# 時間制限や TLS の項目は reverse_options と同じものが使えます。
+	#
+	#   [[reverse]]
+	#   listen = "127.0.0.1:41000"
+	#   target = "www.example.com:22"
+	#   upstream = "backup"
+	#   allow = ["127.0.0.1", "192.168.0.0/16"]
+	#   idle_timeout = "2h"
+	#   max_conns = 4
+	#   description = "踏み台サーバ"
+
+	# HTTP プロキシは -proxy_port からのポートの他に、listen に書いたアドレスでも待ち受けます。
+	# "unix:/run/proxy-relay/http.sock" のように書くと Unix ソケットで待ち受け、
+	# socket_mode と socket_owner でそのファイルの権限を設定できます。
+	[http]
+	listen = ["unix:/run/proxy-relay/http.sock"]
+	socket_mode = "0660"
+	socket_owner = "proxy-relay:docker"
+
+	# ひとつのポートで複数の HTTPS のサービスに繋ぐため、TLS の ClientHello の SNI を見て接続先を選びます。
+	# TLS は終端せず、暗号化されたまま上流の SOCKS プロキシを経由して routes の接続先に中継します。
+	# routes には "*.example.com" のようにサブドメインも指定でき、一致しない場合は default に繋ぎます
+	# (default を省略した場合は接続を閉じます)。TLS ではない接続は HTTP の Host ヘッダで選びます。
+	# クライアントの /etc/hosts でホスト名を proxy-relay のアドレスに向けて使います。
+	[sni.41443]
+	default = "web.internal.example.com:443"
+	[sni.41443.routes]
+	"git.example.com" = "git.internal.example.com:443"
+	"*.apps.example.com" = "apps-lb.internal.example.com:443"
+
+	# 平文の HTTP のサービスをひとつのポートにまとめるため、リクエストの Host ヘッダを見て接続先を選びます。
+	# Keep-Alive の接続でもリクエストごとに振り分け直し、上流の SOCKS プロキシを経由して routes の接続先に中継します。
+	# 接続先のポート番号を省略した場合は 80 番に繋ぎ、一致しない場合は default に、default も無ければ 502 を返します。
+	# rewrite_host を true にすると接続先へ送る Host ヘッダを接続先のホスト名に書き換えます。
+	[vhost.41080]
+	rewrite_host = true
+	[vhost.41080.routes]
+	"wiki.example.com" = "wiki.internal.example.com"
+	"jenkins.example.com" = "ci.internal.example.com:8080"
+
+	# HTTP プロキシとして中継する際の上流への接続は全てのポートで共有され、設定の再読み込み後も使いまわされます。
+	# max_idle_conns_per_host は保持する待機中の接続数 (既定値 16)、idle_conn_timeout は待機中の接続を閉じるまでの時間 (既定値 "90s")、
+	# response_header_timeout はレスポンスヘッダを受け取るまでの時間の上限 (既定値は無制限) です。
+	[transport]
+	max_idle_conns_per_host = 16
+	idle_conn_timeout = "90s"
+	response_header_timeout = "60s"
+
+	# HTTP プロキシとして中継する際に、クライアントの情報を上流へ伝えるヘッダの扱いを設定します。
+	# x_forwarded_for, x_real_ip, forwarded (RFC 7239) にはそれぞれ以下のいずれかを指定します (既定値は "off")。
+	#   "off"     ヘッダを付けず、クライアントから送られてきた値も削除します。
+	#   "on"      クライアントの IP アドレスを付けます。送られてきた値は trusted からの場合のみ引き継ぎます。
+	#   "trusted" trusted に含まれるクライアントからのリクエストにのみ付けます。
+	# via は Via ヘッダで名乗る名前で、"" を指定すると Via ヘッダを付けません (既定値は "proxy-relay")。
+	# クライアントが送ってきた Proxy-Authorization と Proxy-Connection は常に削除されます。
+	[forward_headers]
+	x_forwarded_for = "trusted"
+	x_real_ip = "off"
+	forwarded = "off"
+	via = "proxy-relay"
+	trusted = ["127.0.0.1", "192.168.0.0/16"]
+
+	# HTTP プロキシとして中継するリクエストとそのレスポンスのヘッダを、接続先ごとに書き換えられます。
+	# host には "*.example.com" のようにサブドメインを、path には末尾を "*" にして前方一致を指定できます。
+	# host, method, path を省略した場合は全てに一致し、一致した規則は記述した順に remove, set, add の順で適用されます。
+	[[header_rules]]
+	host = "api.example.com"
+	[header_rules.request]
+	set = { "User-Agent" = "proxy-relay" }
+
+	[[header_rules]]
+	host = "*.corp.example.com"
+	[header_rules.request]
+	add = { "X-Internal-Auth" = "secret-token" }
+
+	[[header_rules]]
+	host = "tracker.example.net"
+	[header_rules.response]
+	remove = ["Set-Cookie"]
+
+	# hosts に一致する接続先への CONNECT は TLS を終端し、中の HTTP リクエストにも header_rules などを適用します。
+	# 証明書はローカルの認証局でその場で発行されるため、クライアントには /ca.pem からダウンロードできる
+	# 認証局の証明書をインストールしておく必要があります。
+	# ca_cert と ca_key は設定ファイルからの相対パスで、存在しない場合は新しく作成されます (既定値は "ca.pem" と "ca-key.pem")。
+	# CONNECT で指定したホストと異なる Host ヘッダのリクエストは 421 で拒否します。
+	[mitm]
+	hosts = ["*.corp.example.com"]
+	ca_cert = "ca.pem"
+	ca_key = "ca-key.pem"
+
+	# 以下の接続先へのリクエストは上流へ送らずに拒否します。
+	# HTTP のリクエストには拒否したことを説明する HTML を、CONNECT には 403 を返し、ログに記録します。
+	# exact は完全一致、suffix はサブドメインを含めた一致で、"example.com/ads/" のようにパスの前方一致も指定できます。
+	# regex は "example.com/path" のようにホスト名とパスを繋げた文字列に対する正規表現です。
+	# files には hosts 形式 ("0.0.0.0 example.com") または Adblock 形式 ("||example.com^") の一覧ファイルを指定でき、
+	# 設定ファイルと同じく変更されると再読み込みされます。
+	# page には拒否した際に返す HTML のテンプレートを指定できます ({{.Host}}, {{.URL}}, {{.Rule}} が使えます)。
+	[blocklist]
+	exact = ["telemetry.example.com"]
+	suffix = ["ads.example.net"]
+	regex = ["^metrics[0-9]*\\."]
+	files = ["blocklist.txt"]
+	page = "blocked.html"
+
+	# HTTP プロキシとして中継した GET リクエストのレスポンスを RFC 9111 に従ってディスクにキャッシュします。
+	# Cache-Control, Expires, Vary を解釈し、期限切れのものは ETag や Last-Modified で上流に確認してから返します。
+	# dir は設定ファイルからの相対パスで、省略した場合はキャッシュしません。
+	# max_size は全体の大きさの上限で、超えると最も長く使われていないものから削除されます (既定値は "1GB")。
+	# キャッシュは http://proxy/cache/purge に url または host を POST すると削除できます。
+	[cache]
+	dir = "cache"
+	max_size = "1GB"
+
+	# 指定したポートの UDP と TCP で DNS の問い合わせを受け付け、上流の SOCKS プロキシを経由して
+	# server の DNS サーバに TCP で転送します。応答は TTL の間キャッシュされます。
+	# direct_hosts に含まれる名前は上流を経由せずに direct_server に問い合わせます
+	# (省略した場合は /etc/resolv.conf の nameserver を使います)。
+	[dns]
+	port = 5353
+	server = "10.0.0.53"
+	direct_server = "192.168.1.1"
+
+	# プロキシの設定ができないコンテナや CI などのために、iptables や nftables の REDIRECT で転送された接続を
+	# 受け付け、本来の接続先へ上流の SOCKS プロキシを経由して中継します (Linux のみ)。
+	# sniff を true にすると TLS の SNI や HTTP の Host ヘッダからホスト名を読み取り、
+	# IP アドレスの代わりにホスト名で上流へ接続し、[blocklist] や [[resolve_rules]] もホスト名で判定します。
+	# proxy-relay 自身の通信が転送されないよう、例えば以下のように proxy-relay を実行するユーザーを除外してください。
+	#   iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner proxy-relay -j REDIRECT --to-ports 41500
+	#   iptables -t nat -A PREROUTING -i docker0 -p tcp -j REDIRECT --to-ports 41500
+	[transparent]
+	port = 41500
+	sniff = true
+
+	# 接続先のホスト名を上流の SOCKS プロキシや HTTP プロキシへ渡す前に IP アドレスに置き換えます。
+	# ここに記述した名前は常に指定した IP アドレスで接続され、DNS サーバもこの IP アドレスを返します。
+	# 社内の名前を特定のサーバに固定したり、クライアントの設定を変えずにステージング環境を試したりできます。
+	[hosts]
+	"api.internal.example.com" = "10.0.0.5"
+	"www.example.com" = "192.0.2.10"
+
+	# 接続先ごとに名前解決する場所を指定できます。一致しない場合は [proxies.xxxxxxx] の resolve が使われます。
+	#   "remote"            ホスト名のまま上流へ渡し、上流の向こう側で解決します (既定値)。
+	#   "local"             手元で解決した IP アドレスを上流へ渡します。解決できなければ接続を失敗させます。
+	#   "local-then-remote" 手元で解決できればその IP アドレスを、できなければホスト名を上流へ渡します。
+	# HTTPS のリクエスト (MITM で復号したものを含む) は上流へ IP アドレスへの CONNECT を送り、証明書はホスト名で検証します。
+	# wss:// の WebSocket のリクエストだけは証明書の検証のためホスト名のまま上流へ渡します。この置き換えは [hosts] にも適用されます。
+	# DNS サーバは "local" の名前を direct_server に、"local-then-remote" の名前を先に direct_server に問い合わせます。
+	[[resolve_rules]]
+	host = "*.lan.example.com"
+	resolve = "local"
+
 	# 接続先になるプロキシは以下のように設定します。
 	# 現在の実装ではリバースプロキシと HTTP Connect メソッドの使用時に SOCKSv5 が使用されています。
 	# それらを使用しない場合は socks_port を設定しなくても構いません。
@@ -78,18 +289,51 @@ proxy-relay の実行中にこのファイルが編集された場合などに
 	socks_port = 1081
 	username = "your-user-name"
 	password = "hack-me"
+	resolve = "remote"
+
+Systemd
+
+systemd のソケットアクティベーションで起動した場合は、systemd から受け取ったソケットで待ち受けます。
+ソケットは FileDescriptorName= で待ち受ける設定と対応させ、TCP ならポート番号を、Unix ソケットならファイルのパスを指定します。
+FileDescriptorName= が無い場合はソケットのアドレスから対応させます。
+受け取ったソケットは設定を再読み込みしても閉じないため、再読み込みの間に届いた接続も取りこぼしません。
+起動時の設定で使わなかったソケットはその時点で閉じるため、後から設定に加えても使われません。
+DNS サーバのポートは対象外です。
+
+	# proxy-relay.socket
+	[Socket]
+	ListenStream=40000
+	FileDescriptorName=40000
+	ListenStream=/run/proxy-relay/http.sock
+	FileDescriptorName=/run/proxy-relay/http.sock
+
+	# proxy-relay.service
+	[Service]
+	Type=notify-reload
+	ExecStart=/usr/local/bin/proxy-relay -c /etc/proxy-relay/config.toml -ports 1
+	WatchdogSec=30
+
+Type=notify または Type=notify-reload では、起動や再読み込みの完了と終了処理の開始を systemd に通知します。
+WatchdogSec= を設定すると、その半分の間隔で生きていることを通知します。
+SIGUSR2 で新しいプロセスに引き継いだ場合は MAINPID= で新しいプロセスを通知するため、systemctl kill -s USR2 proxy-relay で実行ファイルを入れ替えられます。
 
 */
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mimoto-xxxxxx/proxy-relay/config"
@@ -99,14 +343,32 @@ import (
 )
 
 type relay struct {
+	mu          sync.Mutex // reload と shutdown を直列化する
 	running     []io.Closer
+	upstream    *proxy.Upstream  // 全ての HTTP ポートで共有する上流への接続プール
+	ca          *proxy.CA        // TLS を終端する際に証明書を発行する認証局
+	caFiles     [2]string        // ca を読み込んだ証明書と秘密鍵のファイル名
+	selfSigned  *tls.Certificate // 証明書の指定が無いリバースプロキシで TLS を終端する際の自己署名の証明書
+	blocker     *proxy.Blocker   // 全ての HTTP ポートで共有する接続の拒否の設定
+	cache       *proxy.Cache     // 全ての HTTP ポートで共有するレスポンスのキャッシュ
+	dnsCache    *proxy.DNSCache  // DNS サーバの応答のキャッシュ
 	cfg         *config.Config
 	toml        string
 	port        int
 	numPorts    int
 	address     string
 	bindAddress string
+	grace       time.Duration
 	verbose     bool
+	ready       bool // systemd に READY=1 を通知済みかどうか
+	handedOff   bool // upgrade で新しいプロセスにソケットを引き継いだかどうか
+	watcher     *fsnotify.Watcher
+	watching    map[string]bool // watcher で監視しているディレクトリ
+}
+
+// shutdowner は処理中の接続を待ってから終了できるサーバ。
+type shutdowner interface {
+	Shutdown(timeout time.Duration) error
 }
 
 func (rl *relay) Close() error {
@@ -120,13 +382,113 @@ func (rl *relay) Close() error {
 	return nil
 }
 
+// shutdown は全てのサーバで新しい接続の受付を止め、処理中の接続が完了するのを最大 timeout まで待つ。
+func (rl *relay) shutdown(timeout time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range rl.running {
+		wg.Add(1)
+		go func(srv io.Closer) {
+			defer wg.Done()
+			if s, ok := srv.(shutdowner); ok {
+				s.Shutdown(timeout)
+				return
+			}
+			srv.Close()
+		}(srv)
+	}
+	wg.Wait()
+	rl.running = nil
+}
+
 // reload は設定情報を再読み込みする。
-func (rl *relay) reload() error {
-	var err error
-	rl.cfg, err = config.New(rl.toml)
+// 途中で失敗した場合は、それまでに起動したサーバを閉じてから err を返す。
+func (rl *relay) reload() (err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.handedOff {
+		return errors.New("listeners are handed off to the new process, ignoring reload")
+	}
+	// 起動時は main で READY=1 を通知する
+	if rl.ready {
+		if err := proxy.NotifyReloading(); err != nil {
+			log.Println("sd_notify:", err)
+		}
+		defer rl.notify("READY=1")
+	}
+
+	cfg, err := config.New(rl.toml, rl.port, rl.numPorts)
 	if err != nil {
 		return err
 	}
+	if err := rl.updateWatch(cfg); err != nil {
+		log.Println("could not watch:", err)
+	}
+
+	// 証明書を読み込めない場合に動いているサーバを止めてしまわないよう、TLS の設定は Close の前に作る
+	serverTLS := make([]*tls.Config, len(cfg.Reverse))
+	backendTLS := make([]*tls.Config, len(cfg.Reverse))
+	for i, rv := range cfg.Reverse {
+		addr := rv.Listen(rl.bindAddress)
+		if rv.TLS != nil {
+			// 自己署名の証明書はクライアントが例外として登録できるよう再読み込み後も使いまわす
+			if rv.TLS.CertFile == "" && rl.selfSigned == nil {
+				if rl.selfSigned, err = proxy.SelfSignedCertificate([]string{rl.address, "localhost", "127.0.0.1"}); err != nil {
+					return fmt.Errorf("could not create certificate: %v", err)
+				}
+			}
+			if serverTLS[i], err = proxy.NewServerTLS(rv.TLS, rl.selfSigned); err != nil {
+				return fmt.Errorf("reverse %s: %v", addr, err)
+			}
+		}
+		if rv.BackendTLS != nil {
+			if backendTLS[i], err = proxy.NewClientTLS(rv.BackendTLS); err != nil {
+				return fmt.Errorf("reverse %s: %v", addr, err)
+			}
+		}
+	}
+
+	// 認証局は TLS を終端する設定がある時だけ読み込む。発行済みの証明書を使いまわすためファイルが同じなら読み直さない
+	// 読み込めない場合に動いているサーバを止めてしまわないよう、これも Close の前に行う
+	var mitm *proxy.MITM
+	if len(cfg.MITM.Hosts) > 0 {
+		files := [2]string{cfg.MITM.CACert, cfg.MITM.CAKey}
+		if rl.ca == nil || rl.caFiles != files {
+			ca, err := proxy.LoadCA(files[0], files[1])
+			if err != nil {
+				return fmt.Errorf("could not load CA: %v", err)
+			}
+			rl.ca, rl.caFiles = ca, files
+		}
+		mitm = &proxy.MITM{CA: rl.ca, Hosts: cfg.MITM.Hosts}
+	}
+
+	var blocker *proxy.Blocker
+	if cfg.Blocklist.Len() > 0 {
+		if blocker, err = proxy.NewBlocker(cfg.Blocklist, cfg.BlockPage); err != nil {
+			return fmt.Errorf("could not load block page: %v", err)
+		}
+	}
+	rl.blocker = blocker
+
+	// 保存先が同じならキャッシュを使いまわし、大きさの上限だけを反映する
+	// 保存先を開けない場合も動いているサーバを止めないよう、Close の前に開く
+	cache := rl.cache
+	switch {
+	case cfg.Cache.Dir == "":
+		cache = nil
+	case cache == nil || cache.Dir() != cfg.Cache.Dir:
+		if cache, err = proxy.OpenCache(cfg.Cache.Dir, cfg.Cache.MaxSize); err != nil {
+			return fmt.Errorf("could not open cache: %v", err)
+		}
+	default:
+		cache.SetMaxSize(cfg.Cache.MaxSize)
+	}
+	rl.cache = cache
+	rl.cfg = cfg
 
 	if err = rl.Close(); err != nil {
 		return err
@@ -136,19 +498,53 @@ func (rl *relay) reload() error {
 	runtime.Gosched()
 
 	var srvs []io.Closer
+	defer func() {
+		if err != nil {
+			for _, srv := range srvs {
+				srv.Close()
+			}
+		}
+	}()
+
+	// 上流の設定が変わっていなければ接続プールを使いまわす
+	if rl.upstream == nil || !rl.upstream.Matches(rl.cfg.Proxy, rl.cfg.Transport, rl.cfg.Timeouts.Dial) {
+		if rl.upstream != nil {
+			rl.upstream.CloseIdleConnections()
+		}
+		rl.upstream = proxy.NewUpstream(rl.cfg.Proxy, rl.cfg.Transport, rl.cfg.Timeouts.Dial)
+	}
+
+	resolver := proxy.NewResolver(rl.cfg.Hosts, rl.cfg.ResolveRules, rl.cfg.Proxy.Resolve)
 
 	//HTTP プロキシの構築
-	listenErr := make(chan error)
+	// -proxy_port からの各ポートの他に、設定ファイルの [http] の listen でも待ち受ける
+	addrs := make([]string, 0, rl.numPorts+len(rl.cfg.HTTPListen))
 	for i := rl.port; i < rl.port+rl.numPorts; i++ {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", rl.bindAddress, i))
+	}
+	addrs = append(addrs, rl.cfg.HTTPListen...)
+	listenErr := make(chan error)
+	for _, addr := range addrs {
 
 		mux := http.NewServeMux()
 		mux.HandleFunc("/", rl.serveStat)
 		mux.HandleFunc("/reload", rl.serveReload)
 		mux.HandleFunc("/proxy.pac", rl.serveProxyPac)
+		mux.HandleFunc("/ca.pem", rl.serveCA)
+		mux.HandleFunc("/cache/purge", rl.serveCachePurge)
 
 		srv := proxy.NewHTTP(rl.cfg.Proxy)
 		srv.Handler = mux
-		go srv.ListenAndServe(fmt.Sprintf("%s:%d", rl.bindAddress, i), listenErr)
+		srv.Timeouts = rl.cfg.Timeouts
+		srv.Upstream = rl.upstream
+		srv.Headers = rl.cfg.ForwardHeaders
+		srv.HeaderRules = rl.cfg.HeaderRules
+		srv.MITM = mitm
+		srv.Blocker = blocker
+		srv.Cache = rl.cache
+		srv.Resolver = resolver
+		srv.Socket = rl.cfg.HTTPSocket
+		go srv.ListenAndServe(addr, listenErr)
 		if err := <-listenErr; err != nil {
 			return fmt.Errorf("could not listen: %v", err)
 		}
@@ -156,8 +552,28 @@ func (rl *relay) reload() error {
 	}
 
 	// SOCKS リバースプロキシの構築
-	for port, connectTo := range rl.cfg.ReverseMap {
-		srv := proxy.NewSOCKS(connectTo, rl.cfg.Proxy)
+	for i, rv := range rl.cfg.Reverse {
+		srv := proxy.NewSOCKS(rv.Target, rv.Upstream)
+		srv.Timeouts = rv.Timeouts
+		srv.Resolver = resolver
+		srv.Allow = rv.Allow
+		srv.MaxConns = rv.MaxConns
+		srv.Socket = rv.Socket
+		srv.TLS = serverTLS[i]
+		srv.BackendTLS = backendTLS[i]
+		go srv.ListenAndServe(rv.Listen(rl.bindAddress), listenErr)
+		if err := <-listenErr; err != nil {
+			return fmt.Errorf("could not listen: %v", err)
+		}
+		srvs = append(srvs, srv)
+	}
+
+	// SNI で接続先を選ぶリバースプロキシの構築
+	for port, route := range rl.cfg.SNIRoutes {
+		srv := proxy.NewSOCKS(route.Default, rl.cfg.Proxy)
+		srv.Timeouts = rl.cfg.Timeouts
+		srv.Resolver = resolver
+		srv.SNI = route
 		go srv.ListenAndServe(fmt.Sprintf("%s:%d", rl.bindAddress, port), listenErr)
 		if err := <-listenErr; err != nil {
 			return fmt.Errorf("could not listen: %v", err)
@@ -165,6 +581,50 @@ func (rl *relay) reload() error {
 		srvs = append(srvs, srv)
 	}
 
+	// Host ヘッダで接続先を選ぶリバースプロキシの構築
+	for port, route := range rl.cfg.VHosts {
+		srv := proxy.NewVHost(route, rl.cfg.Proxy)
+		srv.Timeouts = rl.cfg.Timeouts
+		srv.Resolver = resolver
+		go srv.ListenAndServe(fmt.Sprintf("%s:%d", rl.bindAddress, port), listenErr)
+		if err := <-listenErr; err != nil {
+			return fmt.Errorf("could not listen: %v", err)
+		}
+		srvs = append(srvs, srv)
+	}
+
+	// 透過プロキシの構築
+	if rl.cfg.Transparent.Port != 0 {
+		srv := proxy.NewTransparent(rl.cfg.Proxy)
+		srv.Timeouts = rl.cfg.Timeouts
+		srv.Resolver = resolver
+		srv.Blocker = blocker
+		srv.Sniff = rl.cfg.Transparent.Sniff
+		go srv.ListenAndServe(fmt.Sprintf("%s:%d", rl.bindAddress, rl.cfg.Transparent.Port), listenErr)
+		if err := <-listenErr; err != nil {
+			return fmt.Errorf("could not listen: %v", err)
+		}
+		srvs = append(srvs, srv)
+	}
+
+	// 上流を経由する DNS サーバの構築
+	if rl.cfg.DNS.Port != 0 {
+		if rl.dnsCache == nil || !rl.dnsCache.Matches(rl.cfg.DNS.Server) {
+			rl.dnsCache = proxy.NewDNSCache(rl.cfg.DNS.Server)
+		}
+		srv := proxy.NewDNS(rl.cfg.DNS.Server, rl.cfg.Proxy)
+		srv.Cache = rl.dnsCache
+		srv.Timeouts = rl.cfg.Timeouts
+		srv.DirectHosts = rl.cfg.DirectHosts
+		srv.DirectServer = rl.cfg.DNS.DirectServer
+		srv.Resolver = resolver
+		go srv.ListenAndServe(fmt.Sprintf("%s:%d", rl.bindAddress, rl.cfg.DNS.Port), listenErr)
+		if err := <-listenErr; err != nil {
+			return fmt.Errorf("could not listen: %v", err)
+		}
+		srvs = append(srvs, srv)
+	}
+
 	rl.running = srvs
 
 	if rl.verbose {
@@ -204,13 +664,115 @@ func (rl *relay) watch() error {
 			}
 		}
 	}()
-	if err = w.Watch(path.Dir(rl.toml)); err != nil {
+	defer w.Close()
+
+	rl.mu.Lock()
+	rl.watcher = w
+	rl.watching = make(map[string]bool)
+	err = rl.updateWatch(rl.cfg)
+	rl.mu.Unlock()
+	if err != nil {
 		return err
 	}
-	defer w.Close()
 	return <-done
 }
 
+// updateWatch は設定ファイルと cfg の blocklist の一覧ファイルがあるディレクトリを監視し、不要になったディレクトリの監視をやめる。
+// rl.mu を確保した状態で呼び出す。
+func (rl *relay) updateWatch(cfg *config.Config) error {
+	if rl.watcher == nil {
+		return nil
+	}
+	dirs := map[string]bool{path.Dir(rl.toml): true}
+	for _, f := range cfg.Blocklist.Files() {
+		dirs[path.Dir(f)] = true
+	}
+	for dir := range rl.watching {
+		if !dirs[dir] {
+			rl.watcher.RemoveWatch(dir)
+			delete(rl.watching, dir)
+		}
+	}
+	for dir := range dirs {
+		if rl.watching[dir] {
+			continue
+		}
+		if err := rl.watcher.Watch(dir); err != nil {
+			return err
+		}
+		rl.watching[dir] = true
+	}
+	return nil
+}
+
+// notify は systemd に state を通知する。失敗した場合はログに出力する。
+func (rl *relay) notify(state string) {
+	if err := proxy.Notify(state); err != nil {
+		log.Println("sd_notify:", err)
+	}
+}
+
+// watchdog は systemd の WatchdogSec= に従って interval ごとに WATCHDOG=1 を通知する。
+// 設定の再読み込みなどが mu を確保したまま止まっている間は通知しないため、その場合は systemd が再起動する。
+func (rl *relay) watchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		rl.mu.Lock()
+		rl.mu.Unlock()
+		rl.notify("WATCHDOG=1")
+	}
+}
+
+// handleSignals は SIGHUP で設定を再読み込みし、SIGUSR2 で新しいプロセスにソケットを引き継いでから、
+// SIGTERM と SIGINT ではそのまま終了処理を行う。
+func (rl *relay) handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	for sig := range c {
+		switch {
+		case sig == syscall.SIGHUP:
+			if rl.verbose {
+				log.Println("receive SIGHUP")
+			}
+			if err := rl.reload(); err != nil {
+				log.Println(err)
+			}
+			continue
+		case isUpgradeSignal(sig):
+			pid, err := rl.upgrade()
+			if err != nil {
+				log.Println("upgrade:", err)
+				continue
+			}
+			log.Printf("receive %v, handed off listeners to pid %d, shutting down (grace period %v)", sig, pid, rl.grace)
+		default:
+			log.Printf("receive %v, shutting down (grace period %v)", sig, rl.grace)
+			rl.notify("STOPPING=1")
+		}
+
+		go func() {
+			// 待機中にもう一度シグナルを受け取ったら待たずに終了する
+			for sig := range c {
+				if sig != syscall.SIGHUP && !isUpgradeSignal(sig) {
+					log.Printf("receive %v, exit immediately", sig)
+					os.Exit(1)
+				}
+			}
+		}()
+		rl.shutdown(rl.grace)
+		os.Exit(0)
+	}
+}
+
+// check は設定ファイルを検証して結果を出力し、終了コードを返す。
+func (rl *relay) check() int {
+	if _, err := config.New(rl.toml, rl.port, rl.numPorts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: OK\n", rl.toml)
+	return 0
+}
+
 func main() {
 	rl := &relay{}
 
@@ -219,12 +781,38 @@ func main() {
 	flag.IntVar(&rl.numPorts, "ports", 4, "listening ports")
 	flag.StringVar(&rl.address, "addr", "localhost", "myself address")
 	flag.StringVar(&rl.bindAddress, "bind", "", "server bind address")
+	flag.DurationVar(&rl.grace, "grace", 10*time.Second, "shutdown grace period")
 	flag.BoolVar(&rl.verbose, "v", false, "verbose output")
 	flag.Parse()
+	if flag.Arg(0) == "check" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		os.Exit(rl.check())
+	}
 
+	n, err := proxy.InheritListeners()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if n > 0 && rl.verbose {
+		log.Printf("inherit %d sockets from systemd", n)
+	}
 	if err := rl.reload(); err != nil {
 		log.Fatalln("cannot open configuration file:", err)
 	}
+	if n := proxy.CloseUnclaimed(); n > 0 {
+		log.Printf("closed %d inherited sockets not used by the configuration", n)
+	}
+	rl.ready = true
+	if handedOff, err := proxy.HandoffReady(); err != nil {
+		log.Fatalln(err)
+	} else if !handedOff {
+		rl.notify("READY=1")
+	}
+	if d := proxy.WatchdogInterval(); d > 0 {
+		go rl.watchdog(d)
+	}
+
+	go rl.handleSignals()
 
 	fmt.Printf("Listening on http://%s:%d/\n", rl.address, rl.port)
 	if err := rl.watch(); err != nil {
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// signals は handleSignals で受け取るシグナル。Windows には SIGUSR2 が無いため引き継ぎは行わない。
+var signals = []os.Signal{syscall.SIGHUP, syscall.SIGTERM, os.Interrupt}
+
+// isUpgradeSignal は常に false を返す。
+func isUpgradeSignal(sig os.Signal) bool {
+	return false
+}
+
+// upgrade はこのプラットフォームでは使えない。
+func (rl *relay) upgrade() (int, error) {
+	return 0, errors.New("handoff is not supported on this platform")
+}
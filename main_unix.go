@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/proxy"
+)
+
+// signals は handleSignals で受け取るシグナル。
+var signals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGTERM, os.Interrupt}
+
+// handoffTimeout は upgrade で起動した新しいプロセスの起動が完了するのを待つ最大時間。
+const handoffTimeout = 30 * time.Second
+
+// isUpgradeSignal は sig が新しいプロセスへの引き継ぎを指示する SIGUSR2 かどうかを返す。
+func isUpgradeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// upgrade は実行ファイルを起動し直して待ち受けているソケットを引き継がせ、新しいプロセスの ID を返す。
+// 成功した後は設定を再読み込みしない。
+func (rl *relay) upgrade() (int, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.handedOff {
+		return 0, errors.New("already handed off")
+	}
+	pid, err := proxy.Handoff(handoffTimeout)
+	if err != nil {
+		return 0, err
+	}
+	rl.handedOff = true
+	// systemd には新しいプロセスを監視するよう通知する
+	rl.notify(fmt.Sprintf("MAINPID=%d", pid))
+	return pid, nil
+}
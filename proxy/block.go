@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+const blockPageTemplate = `<!DOCTYPE html>
+<html lang="ja">
+<meta charset="utf-8">
+<title>接続が拒否されました</title>
+<body>
+  <h1>接続が拒否されました</h1>
+  <p>{{.Host}} への接続は proxy-relay の設定により拒否されています。</p>
+  <p><small>URL: {{.URL}}<br>規則: {{.Rule}}</small></p>
+</body>
+</html>
+`
+
+// Blocker は Blocklist に一致するリクエストを上流へ送らずに拒否する。全ての HTTP ポートで共有する。
+type Blocker struct {
+	list *config.Blocklist
+	page *template.Template
+	hits int64
+}
+
+// NewBlocker は list に一致するリクエストを拒否する Blocker を作成する。
+// pageFile が空でなければ拒否した時に返す HTML のテンプレートとして使用する。
+func NewBlocker(list *config.Blocklist, pageFile string) (*Blocker, error) {
+	var page *template.Template
+	var err error
+	if pageFile != "" {
+		page, err = template.ParseFiles(pageFile)
+	} else {
+		page, err = template.New("").Parse(blockPageTemplate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Blocker{list: list, page: page}, nil
+}
+
+// Len は規則の数を返す。
+func (b *Blocker) Len() int {
+	if b == nil {
+		return 0
+	}
+	return b.list.Len()
+}
+
+// Hits は拒否したリクエストの数を返す。
+func (b *Blocker) Hits() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.hits)
+}
+
+// block は r が拒否の対象であれば拒否のレスポンスを返して true を返す。
+// CONNECT の場合は 403 だけを、それ以外の場合は拒否したことを説明する HTML を返す。
+func (b *Blocker) block(w http.ResponseWriter, r *http.Request, logger *log.Logger) bool {
+	if b == nil {
+		return false
+	}
+	host, path, target := hostname(r.URL), r.URL.Path, r.URL.String()
+	if r.Method == "CONNECT" {
+		path, target = "", r.URL.Host
+	}
+	rule, ok := b.list.Match(host, path)
+	if !ok {
+		return false
+	}
+
+	atomic.AddInt64(&b.hits, 1)
+	logger.Printf("blocked: %s %s from %s (rule: %s)", r.Method, target, clientIP(r.RemoteAddr), rule)
+
+	if r.Method == "CONNECT" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	b.page.Execute(w, map[string]interface{}{
+		"Host": host,
+		"URL":  r.URL.String(),
+		"Rule": rule,
+	})
+	return true
+}
+
+// blockConn は透過プロキシなどで受け付けた接続の接続先 target ("example.com:443" の形式) が
+// 拒否の対象かを調べ、対象であればログに記録して true を返す。
+func (b *Blocker) blockConn(target, remoteAddr string, logger *log.Logger) bool {
+	if b == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	rule, ok := b.list.Match(host, "")
+	if !ok {
+		return false
+	}
+	atomic.AddInt64(&b.hits, 1)
+	logger.Printf("blocked: %s from %s (rule: %s)", target, clientIP(remoteAddr), rule)
+	return true
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxCertificates は CA が発行済みの証明書を覚えておく最大の数。超えた場合は最も長く使われていないものから忘れる。
+const maxCertificates = 1000
+
+// CA は TLS を終端する際に接続先のホスト名の証明書をその場で発行する認証局。
+type CA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	leafKey *ecdsa.PrivateKey // 発行する証明書で共通して使用する鍵
+
+	mu    sync.Mutex
+	cache map[string]*list.Element // ホスト名ごとに発行済みの証明書。要素の値は *issuedCert
+	lru   *list.List               // 最近使われたものが先頭
+}
+
+// issuedCert は発行済みの証明書とそのホスト名。
+type issuedCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+// LoadCA は certFile と keyFile から認証局の証明書と秘密鍵を読み込む。
+// どちらのファイルも存在しない場合は新しい認証局を作成して保存する。
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+			return createCA(certFile, keyFile)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s: not a CA certificate", certFile)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key", keyFile)
+	}
+	return newCA(cert, certPEM, key)
+}
+
+// createCA は新しい認証局を作成し、certFile と keyFile に保存する。
+func createCA(certFile, keyFile string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "proxy-relay local CA", Organization: []string{"proxy-relay"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return newCA(cert, certPEM, key)
+}
+
+func newCA(cert *x509.Certificate, certPEM []byte, key crypto.Signer) (*CA, error) {
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{
+		cert:    cert,
+		certPEM: certPEM,
+		key:     key,
+		leafKey: leafKey,
+		cache:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// CertPEM はクライアントにインストールするための認証局の証明書を PEM 形式で返す。
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Certificate は host 用の証明書を返す。発行済みのものがあればそれを使いまわす。
+func (ca *CA) Certificate(host string) (*tls.Certificate, error) {
+	if host == "" {
+		return nil, errors.New("no server name")
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if e, ok := ca.cache[host]; ok {
+		if c := e.Value.(*issuedCert).cert; time.Now().Before(c.Leaf.NotAfter) {
+			ca.lru.MoveToFront(e)
+			return c, nil
+		}
+		ca.lru.Remove(e)
+		delete(ca.cache, host)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 397),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	if tmpl.NotAfter.After(ca.cert.NotAfter) {
+		tmpl.NotAfter = ca.cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, ca.leafKey.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}
+	ca.cache[host] = ca.lru.PushFront(&issuedCert{host: host, cert: c})
+	for ca.lru.Len() > maxCertificates {
+		e := ca.lru.Back()
+		ca.lru.Remove(e)
+		delete(ca.cache, e.Value.(*issuedCert).host)
+	}
+	return c, nil
+}
+
+// SelfSignedCertificate は hosts のための自己署名の証明書を作成する。
+// 証明書ファイルを用意せずに TLS を終端する場合に使う。
+func SelfSignedCertificate(hosts []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "proxy-relay", Organization: []string{"proxy-relay"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 397),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// newSerial は証明書のシリアル番号を生成する。
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
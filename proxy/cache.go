@@ -0,0 +1,730 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache は RFC 9111 に従って HTTP のレスポンスをディスクにキャッシュする共有キャッシュ。
+// 全ての HTTP ポートで共有し、設定の再読み込みをまたいで使いまわす。
+type Cache struct {
+	dir string
+
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string][]*cacheEntry // URL ごとの Vary による変種の一覧
+	lru     *list.List               // 最近使われたものが先頭
+
+	hits        int64
+	misses      int64
+	revalidated int64
+}
+
+// CacheStats はキャッシュの状態。
+type CacheStats struct {
+	Entries     int
+	Size        int64
+	MaxSize     int64
+	Hits        int64 // キャッシュから返したリクエスト数
+	Misses      int64 // 上流から取得したリクエスト数
+	Revalidated int64 // 上流に確認してキャッシュから返したリクエスト数
+}
+
+// cacheEntry はキャッシュしたレスポンスひとつ分の情報。ボディとは別のファイルに JSON で保存する。
+// 複数のリクエストから c.mu を確保せずに読むため、索引に加えた後は elem 以外を変更しない。
+type cacheEntry struct {
+	URL          string
+	Status       int
+	Header       http.Header
+	Vary         map[string]string // Vary に挙げられたヘッダのリクエストでの値
+	RequestTime  time.Time
+	ResponseTime time.Time
+	Size         int64
+
+	id   string
+	elem *list.Element
+}
+
+// hopHeaders は保存しないホップ間のヘッダ。
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Trailer", "Upgrade"}
+
+// heuristicStatus はヒューリスティックにキャッシュできるステータスコード。
+var heuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// OpenCache は dir をキャッシュの保存先として開き、既に保存されているものを読み込む。
+func OpenCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string][]*cacheEntry),
+		lru:     list.New(),
+	}
+
+	metas, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*cacheEntry
+	for _, m := range metas {
+		e, err := c.readEntry(m)
+		if err != nil {
+			// 壊れているものは削除する
+			os.Remove(m)
+			os.Remove(strings.TrimSuffix(m, ".json") + ".body")
+			continue
+		}
+		loaded = append(loaded, e)
+	}
+	// 使われた順番は保存していないため、取得した時刻が新しいものを最近使われたものとする
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].ResponseTime.Before(loaded[j].ResponseTime) })
+	c.mu.Lock()
+	for _, e := range loaded {
+		c.insert(e)
+	}
+	c.evict()
+	c.mu.Unlock()
+
+	// 書き込み途中で終了したものを削除する
+	if tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp")); err == nil {
+		for _, t := range tmps {
+			os.Remove(t)
+		}
+	}
+	return c, nil
+}
+
+// Dir はキャッシュの保存先を返す。
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// SetMaxSize はキャッシュ全体の最大のバイト数を変更する。
+func (c *Cache) SetMaxSize(n int64) {
+	c.mu.Lock()
+	c.maxSize = n
+	c.evict()
+	c.mu.Unlock()
+}
+
+// Stats はキャッシュの状態を返す。
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:     c.lru.Len(),
+		Size:        c.size,
+		MaxSize:     c.maxSize,
+		Hits:        atomic.LoadInt64(&c.hits),
+		Misses:      atomic.LoadInt64(&c.misses),
+		Revalidated: atomic.LoadInt64(&c.revalidated),
+	}
+}
+
+// PurgeURL は rawurl のレスポンスをキャッシュから削除し、削除した数を返す。
+func (c *Cache) PurgeURL(rawurl string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries[rawurl])
+	for _, e := range c.entries[rawurl] {
+		c.remove(e)
+	}
+	return n
+}
+
+// PurgeHost は host (ポート番号を含まない) のレスポンスを全てキャッシュから削除し、削除した数を返す。
+func (c *Cache) PurgeHost(host string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, variants := range c.entries {
+		for _, e := range variants {
+			if u, err := url.Parse(e.URL); err == nil && strings.EqualFold(hostname(u), host) {
+				c.remove(e)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Transport は next から取得したレスポンスをキャッシュする http.RoundTripper を返す。
+func (c *Cache) Transport(next http.RoundTripper) http.RoundTripper {
+	return &cacheTransport{cache: c, next: next}
+}
+
+type cacheTransport struct {
+	cache *Cache
+	next  http.RoundTripper
+}
+
+// RoundTrip はキャッシュから返せる場合はそれを返し、そうでなければ上流から取得して必要ならキャッシュする。
+func (t *cacheTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c := t.cache
+	if r.Method != "GET" {
+		resp, err := t.next.RoundTrip(r)
+		// 安全でないメソッドが成功した場合はその URL のキャッシュを無効にする
+		if err == nil && r.Method != "HEAD" && r.Method != "OPTIONS" && resp.StatusCode < 400 {
+			c.PurgeURL(r.URL.String())
+		}
+		return resp, err
+	}
+	reqCC := parseCacheControl(r.Header)
+	if _, ok := reqCC["no-store"]; ok || r.Header.Get("Range") != "" {
+		return t.next.RoundTrip(r)
+	}
+	if _, ok := reqCC["no-cache"]; !ok && r.Header.Get("Pragma") == "no-cache" && r.Header.Get("Cache-Control") == "" {
+		reqCC["no-cache"] = ""
+	}
+
+	key := r.URL.String()
+	e := c.lookup(key, r)
+	if e != nil && c.fresh(e, reqCC) {
+		if resp, err := c.respond(e, r, "HIT"); err == nil {
+			atomic.AddInt64(&c.hits, 1)
+			return resp, nil
+		}
+		e = nil
+	}
+	if _, ok := reqCC["only-if-cached"]; ok {
+		return gatewayTimeout(r), nil
+	}
+
+	// 期限切れのものは検証子があれば上流に確認する
+	out := r
+	if e != nil {
+		etag, lm := e.Header.Get("Etag"), e.Header.Get("Last-Modified")
+		if etag != "" || lm != "" {
+			out = r.Clone(r.Context())
+			if etag != "" {
+				out.Header.Set("If-None-Match", etag)
+			}
+			if lm != "" {
+				out.Header.Set("If-Modified-Since", lm)
+			}
+		}
+	}
+
+	reqTime := time.Now()
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		if e != nil && !mustRevalidate(e.Header) {
+			if _, ok := reqCC["max-stale"]; ok {
+				return c.respond(e, r, "STALE")
+			}
+		}
+		return nil, err
+	}
+	respTime := time.Now()
+
+	if e != nil && resp.StatusCode == http.StatusNotModified && out != r {
+		resp.Body.Close()
+		if e = c.update(e, resp.Header, reqTime, respTime); e != nil {
+			if resp, err := c.respond(e, r, "REVALIDATED"); err == nil {
+				atomic.AddInt64(&c.revalidated, 1)
+				return resp, nil
+			}
+		}
+		return t.next.RoundTrip(r)
+	}
+	if resp.StatusCode == http.StatusNotModified && out == r {
+		// クライアント自身の条件付きリクエストへの応答はそのまま返す
+		return resp, nil
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+	resp.Header.Set("X-Cache", "MISS")
+	if _, ok := reqCC["no-store"]; ok || !storable(r, resp) {
+		return resp, nil
+	}
+	c.store(key, r, resp, reqTime, respTime)
+	return resp, nil
+}
+
+// lookup は r の Vary に該当するヘッダの値が一致するキャッシュを探す。
+func (c *Cache) lookup(key string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[key] {
+		if e.matchVary(r) {
+			c.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+// matchVary は r が e を保存した際のリクエストと Vary に挙げられたヘッダの値が同じかを返す。
+func (e *cacheEntry) matchVary(r *http.Request) bool {
+	for k, v := range e.Vary {
+		if strings.Join(r.Header.Values(k), ", ") != v {
+			return false
+		}
+	}
+	return true
+}
+
+// fresh は e をリクエストの Cache-Control の指定の元で上流に確認せずに返せるかを判断する。
+func (c *Cache) fresh(e *cacheEntry, reqCC map[string]string) bool {
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	respCC := parseCacheControl(e.Header)
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+	lifetime := freshnessLifetime(e.Header, e.ResponseTime)
+	age := currentAge(e, time.Now())
+
+	if v, ok := reqCC["max-age"]; ok {
+		if d, ok := parseSeconds(v); ok && age > d {
+			return false
+		}
+	}
+	if v, ok := reqCC["min-fresh"]; ok {
+		if d, ok := parseSeconds(v); ok {
+			age += d
+		}
+	}
+	if age < lifetime {
+		return true
+	}
+	// max-stale が指定されていれば期限切れでも返す
+	if v, ok := reqCC["max-stale"]; ok && !mustRevalidate(e.Header) {
+		if v == "" {
+			return true
+		}
+		if d, ok := parseSeconds(v); ok && age-lifetime <= d {
+			return true
+		}
+	}
+	return false
+}
+
+// respond は e をレスポンスとして返す。
+// 同じ識別子のボディは commit で置き換えられるため、e が索引に残っていることを c.mu を確保したまま確かめてから開く。
+func (c *Cache) respond(e *cacheEntry, r *http.Request, status string) (*http.Response, error) {
+	c.mu.Lock()
+	if e.elem == nil {
+		c.mu.Unlock()
+		return nil, errors.New("cache: entry removed")
+	}
+	f, err := os.Open(c.bodyFile(e.id))
+	if err != nil {
+		c.remove(e)
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.mu.Unlock()
+	h := e.Header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(currentAge(e, time.Now())/time.Second), 10))
+	h.Set("X-Cache", status)
+	return &http.Response{
+		Status:        strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          f,
+		ContentLength: e.Size,
+		Request:       r,
+	}, nil
+}
+
+// update は 304 のレスポンスのヘッダで e を更新したものを作り、索引の e と置き換えて返す。
+// e は他のリクエストが読んでいる可能性があるため変更しない。
+// 他のリクエストが先に置き換えていた場合はその新しいものを更新し、既に削除されていた場合は nil を返す。
+func (c *Cache) update(e *cacheEntry, h http.Header, reqTime, respTime time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.elem == nil {
+		var cur *cacheEntry
+		for _, v := range c.entries[e.URL] {
+			if v.id == e.id {
+				cur = v
+			}
+		}
+		if cur == nil {
+			return nil
+		}
+		e = cur
+	}
+	ne := *e
+	ne.Header = e.Header.Clone()
+	for k, vv := range h {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		ne.Header[k] = vv
+	}
+	ne.RequestTime, ne.ResponseTime = reqTime, respTime
+
+	ne.elem.Value = &ne
+	e.elem = nil
+	for i, v := range c.entries[e.URL] {
+		if v == e {
+			c.entries[e.URL][i] = &ne
+		}
+	}
+	c.writeEntry(&ne)
+	return &ne
+}
+
+// store はレスポンスのボディを読み進めながらディスクに書き込み、最後まで読み終えたらキャッシュに加える。
+func (c *Cache) store(key string, r *http.Request, resp *http.Response, reqTime, respTime time.Time) {
+	e := &cacheEntry{
+		URL:          key,
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         make(map[string]string),
+		RequestTime:  reqTime,
+		ResponseTime: respTime,
+	}
+	e.Header.Del("X-Cache")
+	for _, h := range hopHeaders {
+		e.Header.Del(h)
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				e.Vary[name] = strings.Join(r.Header.Values(name), ", ")
+			}
+		}
+	}
+	e.id = entryID(key, e.Vary)
+
+	c.mu.Lock()
+	max := c.maxSize
+	c.mu.Unlock()
+	if resp.ContentLength > max {
+		return
+	}
+	f, err := os.CreateTemp(c.dir, e.id+"-*.tmp")
+	if err != nil {
+		return
+	}
+	resp.Body = &cacheWriter{
+		ReadCloser: resp.Body,
+		file:       f,
+		cache:      c,
+		entry:      e,
+		length:     resp.ContentLength,
+		max:        max,
+	}
+}
+
+// cacheWriter はレスポンスのボディを読み出し元に渡しながら一時ファイルに書き込む。
+type cacheWriter struct {
+	io.ReadCloser
+	file   *os.File
+	cache  *Cache
+	entry  *cacheEntry
+	length int64
+	max    int64 // これを超えたら保存を諦める
+	n      int64
+	failed bool
+	done   bool
+}
+
+func (w *cacheWriter) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if n > 0 && !w.failed {
+		if _, werr := w.file.Write(p[:n]); werr != nil {
+			w.failed = true
+		}
+		w.n += int64(n)
+		if w.n > w.max {
+			w.failed = true
+		}
+	}
+	if err == io.EOF && !w.failed && (w.length < 0 || w.n == w.length) {
+		w.done = true
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Close() error {
+	err := w.ReadCloser.Close()
+	name := w.file.Name()
+	w.file.Close()
+	if !w.done {
+		os.Remove(name)
+		return err
+	}
+	w.entry.Size = w.n
+	w.cache.commit(w.entry, name)
+	return err
+}
+
+// commit は書き込みを終えた e をキャッシュに加える。同じ URL と Vary のものがあれば置き換える。
+func (c *Cache) commit(e *cacheEntry, tmp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, old := range c.entries[e.URL] {
+		if old.id == e.id {
+			c.remove(old)
+		}
+	}
+	if err := os.Rename(tmp, c.bodyFile(e.id)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err := c.writeEntry(e); err != nil {
+		os.Remove(c.bodyFile(e.id))
+		return
+	}
+	c.insert(e)
+	c.evict()
+}
+
+// insert は e を索引に加える。c.mu を確保した状態で呼ぶこと。
+func (c *Cache) insert(e *cacheEntry) {
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.URL] = append(c.entries[e.URL], e)
+	c.size += e.Size
+}
+
+// remove は e を索引とディスクから削除する。c.mu を確保した状態で呼ぶこと。
+func (c *Cache) remove(e *cacheEntry) {
+	if e.elem == nil {
+		return
+	}
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	c.size -= e.Size
+	variants := c.entries[e.URL]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.URL)
+	} else {
+		c.entries[e.URL] = variants
+	}
+	os.Remove(c.metaFile(e.id))
+	os.Remove(c.bodyFile(e.id))
+}
+
+// evict は全体の大きさが上限を超えていれば最も長く使われていないものから削除する。c.mu を確保した状態で呼ぶこと。
+func (c *Cache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+func (c *Cache) metaFile(id string) string {
+	return filepath.Join(c.dir, id+".json")
+}
+
+func (c *Cache) bodyFile(id string) string {
+	return filepath.Join(c.dir, id+".body")
+}
+
+// writeEntry は e の情報をディスクに保存する。
+func (c *Cache) writeEntry(e *cacheEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := c.metaFile(e.id) + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.metaFile(e.id))
+}
+
+// readEntry は保存されている情報を読み込む。
+func (c *Cache) readEntry(name string) (*cacheEntry, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var e cacheEntry
+	if err = json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	e.id = strings.TrimSuffix(filepath.Base(name), ".json")
+	if e.id != entryID(e.URL, e.Vary) {
+		return nil, errors.New("cache: id mismatch")
+	}
+	if fi, err := os.Stat(c.bodyFile(e.id)); err != nil || fi.Size() != e.Size {
+		return nil, errors.New("cache: body missing")
+	}
+	return &e, nil
+}
+
+// entryID は URL と Vary の値からファイル名に使う識別子を作る。
+func entryID(key string, vary map[string]string) string {
+	keys := make([]string, 0, len(vary))
+	for k := range vary {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	io.WriteString(h, key)
+	for _, k := range keys {
+		io.WriteString(h, "\n"+k+": "+vary[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// storable は共有キャッシュとして resp を保存できるかを判断する。
+func storable(r *http.Request, resp *http.Response) bool {
+	if !heuristicStatus[resp.StatusCode] {
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	_, public := cc["public"]
+	// 認証が必要なリクエストは明示的に許可されている場合だけ保存する
+	if r.Header.Get("Authorization") != "" {
+		_, smaxage := cc["s-maxage"]
+		if !public && !smaxage && !mustRevalidate(resp.Header) {
+			return false
+		}
+	}
+	// 利用者ごとの情報を他の利用者に返さないよう Cookie を設定するレスポンスは保存しない
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		if strings.TrimSpace(v) == "*" {
+			return false
+		}
+	}
+	if public || freshnessLifetime(resp.Header, time.Now()) > 0 {
+		return true
+	}
+	// 有効期限が無くても検証子があれば後で確認して使える
+	return resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// mustRevalidate は期限切れの後に確認せずに返してはいけないレスポンスかを返す。
+func mustRevalidate(h http.Header) bool {
+	cc := parseCacheControl(h)
+	_, mr := cc["must-revalidate"]
+	_, pr := cc["proxy-revalidate"]
+	_, sm := cc["s-maxage"]
+	return mr || pr || sm
+}
+
+// freshnessLifetime は共有キャッシュとしての有効期間を求める。
+func freshnessLifetime(h http.Header, respTime time.Time) time.Duration {
+	cc := parseCacheControl(h)
+	if v, ok := cc["s-maxage"]; ok {
+		d, _ := parseSeconds(v)
+		return d
+	}
+	if v, ok := cc["max-age"]; ok {
+		d, _ := parseSeconds(v)
+		return d
+	}
+	date := respTime
+	if d, err := http.ParseTime(h.Get("Date")); err == nil {
+		date = d
+	}
+	if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return exp.Sub(date)
+	}
+	// 更新日時から経過した時間の 10% をヒューリスティックな有効期間とする
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && lm.Before(date) {
+		d := date.Sub(lm) / 10
+		if d > 24*time.Hour {
+			d = 24 * time.Hour
+		}
+		return d
+	}
+	return 0
+}
+
+// currentAge は RFC 9111 4.2.3 に従って e の現在の経過時間を求める。
+func currentAge(e *cacheEntry, now time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		if apparentAge = e.ResponseTime.Sub(date); apparentAge < 0 {
+			apparentAge = 0
+		}
+	}
+	ageValue, _ := parseSeconds(e.Header.Get("Age"))
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if correctedAge < apparentAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+// parseCacheControl は Cache-Control ヘッダを指示子とその値に分解する。
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			k, val := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				k, val = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(k))] = val
+		}
+	}
+	return cc
+}
+
+// parseSeconds は秒数を表す値を解釈する。
+func parseSeconds(s string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// gatewayTimeout は only-if-cached でキャッシュから返せなかった場合のレスポンスを作る。
+func gatewayTimeout(r *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "504 Gateway Timeout",
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Length": {"0"}},
+		Body:       http.NoBody,
+		Request:    r,
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// fakeOrigin は handler を直接呼び出す http.RoundTripper で、呼ばれた回数と最後のリクエストを記録する。
+type fakeOrigin struct {
+	handler http.HandlerFunc
+	n       int
+	last    *http.Request
+}
+
+func (o *fakeOrigin) RoundTrip(r *http.Request) (*http.Response, error) {
+	o.n++
+	o.last = r
+	w := httptest.NewRecorder()
+	o.handler(w, r)
+	resp := w.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+// cacheGet は rt で rawurl を取得し、ボディを最後まで読んでキャッシュへの保存を終えてから X-Cache とボディを返す。
+func cacheGet(t *testing.T, rt http.RoundTripper, rawurl string, header ...string) (string, string) {
+	t.Helper()
+	r, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	resp, err := rt.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Header.Get("X-Cache"), string(b)
+}
+
+func openTestCache(t *testing.T, maxSize int64) *Cache {
+	t.Helper()
+	c, err := OpenCache(t.TempDir(), maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCacheFreshness(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string // レスポンスのヘッダ
+		req    []string          // 2回目のリクエストのヘッダ
+		want   string            // 2回目の X-Cache
+	}{
+		{"max-age", map[string]string{"Cache-Control": "max-age=60"}, nil, "HIT"},
+		{"s-maxage", map[string]string{"Cache-Control": "s-maxage=60, max-age=0"}, nil, "HIT"},
+		{"expired by age", map[string]string{"Cache-Control": "max-age=60", "Age": "120"}, nil, "MISS"},
+		{"no-cache response", map[string]string{"Cache-Control": "max-age=60, no-cache"}, nil, "MISS"},
+		{"no-cache request", map[string]string{"Cache-Control": "max-age=60"}, []string{"Cache-Control", "no-cache"}, "MISS"},
+		{"pragma", map[string]string{"Cache-Control": "max-age=60"}, []string{"Pragma", "no-cache"}, "MISS"},
+		{"request max-age", map[string]string{"Cache-Control": "max-age=60", "Age": "30"}, []string{"Cache-Control", "max-age=10"}, "MISS"},
+		{"max-stale", map[string]string{"Cache-Control": "max-age=60", "Age": "120"}, []string{"Cache-Control", "max-stale"}, "HIT"},
+		{"must-revalidate", map[string]string{"Cache-Control": "max-age=60, must-revalidate", "Age": "120"}, []string{"Cache-Control", "max-stale"}, "MISS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origin := &fakeOrigin{handler: func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				io.WriteString(w, "body")
+			}}
+			rt := openTestCache(t, 1<<20).Transport(origin)
+
+			if xc, _ := cacheGet(t, rt, "http://a.example/"); xc != "MISS" {
+				t.Fatalf("first X-Cache = %q, want MISS", xc)
+			}
+			xc, body := cacheGet(t, rt, "http://a.example/", tt.req...)
+			if xc != tt.want || body != "body" {
+				t.Errorf("second = %q %q, want %q %q", xc, body, tt.want, "body")
+			}
+			if want := map[string]int{"HIT": 1, "MISS": 2}[tt.want]; origin.n != want {
+				t.Errorf("origin requests = %d, want %d", origin.n, want)
+			}
+		})
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	origin := &fakeOrigin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		io.WriteString(w, "enc="+r.Header.Get("Accept-Encoding"))
+	}}
+	c := openTestCache(t, 1<<20)
+	rt := c.Transport(origin)
+
+	for _, want := range []struct{ enc, xcache string }{
+		{"gzip", "MISS"},
+		{"br", "MISS"},
+		{"gzip", "HIT"},
+		{"br", "HIT"},
+		{"", "MISS"},
+	} {
+		xc, body := cacheGet(t, rt, "http://a.example/", "Accept-Encoding", want.enc)
+		if xc != want.xcache || body != "enc="+want.enc {
+			t.Errorf("Accept-Encoding %q: got %q %q, want %q %q", want.enc, xc, body, want.xcache, "enc="+want.enc)
+		}
+	}
+	if n := c.Stats().Entries; n != 3 {
+		t.Errorf("entries = %d, want 3", n)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	version := "v1"
+	origin := &fakeOrigin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Etag", `"`+version+`"`)
+		if r.Header.Get("If-None-Match") == `"`+version+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, version)
+	}}
+	c := openTestCache(t, 1<<20)
+	rt := c.Transport(origin)
+
+	if xc, _ := cacheGet(t, rt, "http://a.example/"); xc != "MISS" {
+		t.Fatalf("first X-Cache = %q, want MISS", xc)
+	}
+	xc, body := cacheGet(t, rt, "http://a.example/")
+	if xc != "REVALIDATED" || body != "v1" {
+		t.Errorf("not modified: got %q %q, want REVALIDATED v1", xc, body)
+	}
+	if got := origin.last.Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("If-None-Match = %q, want %q", got, `"v1"`)
+	}
+
+	// 変更されていれば新しいレスポンスで置き換える
+	version = "v2"
+	if xc, body := cacheGet(t, rt, "http://a.example/"); xc != "MISS" || body != "v2" {
+		t.Errorf("modified: got %q %q, want MISS v2", xc, body)
+	}
+	if xc, body := cacheGet(t, rt, "http://a.example/"); xc != "REVALIDATED" || body != "v2" {
+		t.Errorf("after replace: got %q %q, want REVALIDATED v2", xc, body)
+	}
+	if s := c.Stats(); s.Entries != 1 || s.Revalidated != 2 {
+		t.Errorf("stats = %+v, want 1 entry and 2 revalidated", s)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	origin := &fakeOrigin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "1234")
+	}}
+	c := openTestCache(t, 10)
+	rt := c.Transport(origin)
+
+	cacheGet(t, rt, "http://a.example/a")
+	cacheGet(t, rt, "http://a.example/b")
+	// a を使ったので b が最も長く使われていないものになる
+	if xc, _ := cacheGet(t, rt, "http://a.example/a"); xc != "HIT" {
+		t.Fatalf("a: X-Cache = %q, want HIT", xc)
+	}
+	cacheGet(t, rt, "http://a.example/c")
+
+	if s := c.Stats(); s.Entries != 2 || s.Size != 8 {
+		t.Errorf("stats = %+v, want 2 entries of 8 bytes", s)
+	}
+	for _, want := range []struct{ path, xcache string }{{"/a", "HIT"}, {"/c", "HIT"}, {"/b", "MISS"}} {
+		if xc, _ := cacheGet(t, rt, "http://a.example"+want.path); xc != want.xcache {
+			t.Errorf("%s: X-Cache = %q, want %q", want.path, xc, want.xcache)
+		}
+	}
+
+	// 上限より大きいものは保存しない
+	c.SetMaxSize(3)
+	if s := c.Stats(); s.Entries != 0 || s.Size != 0 {
+		t.Errorf("after SetMaxSize: stats = %+v, want empty", s)
+	}
+	cacheGet(t, rt, "http://a.example/a")
+	if n := c.Stats().Entries; n != 0 {
+		t.Errorf("entries = %d, want 0", n)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	origin := &fakeOrigin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.URL.String())
+	}}
+	c := openTestCache(t, 1<<20)
+	rt := c.Transport(origin)
+	for _, u := range []string{"http://a.example/1", "http://a.example:8080/2", "http://b.example/1"} {
+		cacheGet(t, rt, u)
+	}
+	e := c.lookup("http://a.example/1", &http.Request{})
+
+	if n := c.PurgeURL("http://a.example/1"); n != 1 {
+		t.Errorf("PurgeURL = %d, want 1", n)
+	}
+	if n := c.PurgeURL("http://a.example/1"); n != 0 {
+		t.Errorf("second PurgeURL = %d, want 0", n)
+	}
+	// 削除されたものを参照していたリクエストは、同じ識別子で保存し直されたボディを返さない
+	cacheGet(t, rt, "http://a.example/1")
+	if _, err := c.respond(e, &http.Request{}, "HIT"); err == nil {
+		t.Error("respond succeeded for a purged entry")
+	}
+
+	if n := c.PurgeHost("A.EXAMPLE"); n != 2 {
+		t.Errorf("PurgeHost = %d, want 2", n)
+	}
+	if n := c.Stats().Entries; n != 1 {
+		t.Errorf("entries = %d, want 1", n)
+	}
+	files, err := os.ReadDir(c.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d files left in cache dir, want 2", len(files))
+	}
+	if xc, _ := cacheGet(t, rt, "http://b.example/1"); xc != "HIT" {
+		t.Errorf("b.example: X-Cache = %q, want HIT", xc)
+	}
+}
@@ -2,37 +2,65 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mimoto-xxxxxx/proxy-relay/config"
 
 	"code.google.com/p/go.net/proxy"
 )
 
+const (
+	// keepAlivePeriod は中継する TCP 接続の両側に設定する Keep-Alive の間隔。
+	keepAlivePeriod = 30 * time.Second
+
+	// spliceChunk は時間制限がある場合に ReadFrom で一度に転送する最大のバイト数。
+	// この単位で通信があったことを記録するため、大きすぎると反対方向の無通信判定が不正確になる。
+	spliceChunk = 1 << 20
+)
+
+// bufPool は TCP 同士ではない中継で使用するバッファ。
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+var (
+	errIdleTimeout = errors.New("idle timeout")
+	errMaxDuration = errors.New("max duration exceeded")
+)
+
 // connectSOCKS は pc の設定を元に SOCKS プロキシを経由して host に接続し、通信が完了するまで待つ。
+// tc が nil でなければ接続先との間で TLS を開始し、c とは平文でやり取りする。
 // 接続に成功する前にエラーが発生した場合は connected が false になる。
-func connectSOCKS(c net.Conn, host string, pc *config.Proxy, intro []byte) (connected bool, err error) {
-	var auth *proxy.Auth
-	if pc.Username != "" || pc.Password != "" {
-		auth = &proxy.Auth{
-			User:     pc.Username,
-			Password: pc.Password,
-		}
-	}
-	var d proxy.Dialer
-	d, err = proxy.SOCKS5("tcp", pc.Host+":"+strconv.Itoa(pc.SOCKSPort), auth, &net.Dialer{})
+func connectSOCKS(c net.Conn, host string, pc *config.Proxy, intro []byte, t config.Timeouts, tc *tls.Config) (connected bool, err error) {
+	var conn net.Conn
+	conn, err = dialSOCKS(host, pc, t.Dial)
 	if err != nil {
 		return
 	}
+	defer conn.Close()
 
-	var conn net.Conn
-	conn, err = d.Dial("tcp", host)
-	if err != nil {
-		return
+	if tc != nil {
+		tlsConn := tls.Client(conn, tc)
+		if t.Dial > 0 {
+			tlsConn.SetDeadline(time.Now().Add(t.Dial))
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			err = fmt.Errorf("%s: TLS handshake: %v", host, err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
 	}
 
 	if intro != nil {
@@ -43,30 +71,290 @@ func connectSOCKS(c net.Conn, host string, pc *config.Proxy, intro []byte) (conn
 
 	connected = true
 
+	if err = pipe(c, conn, t); isTimeout(err) {
+		err = fmt.Errorf("%s: closed: %v", host, err)
+	}
+	return
+}
+
+// connectUnix は手元の Unix ソケット path に接続し、通信が完了するまで c との間で中継する。
+func connectUnix(c net.Conn, path string, t config.Timeouts) error {
+	conn, err := net.DialTimeout("unix", path, t.Dial)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = pipe(c, conn, t); isTimeout(err) {
+		err = fmt.Errorf("%s: closed: %v", path, err)
+	}
+	return err
+}
+
+// pipe は a と b の間で双方向に中継し、両方向とも終わるまで待つ。
+// 中継を打ち切る原因になったエラーがあればそれを返す。
+func pipe(a, b net.Conn, t config.Timeouts) error {
+	setKeepAlive(a)
+	setKeepAlive(b)
+
+	tn := &tunnel{timeouts: t, start: time.Now()}
+	tn.touch()
+
 	var wg sync.WaitGroup
-	var e1, e2 error
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		_, e1 = io.Copy(c, conn)
+		tn.relay(a, b)
 	}()
 	go func() {
 		defer wg.Done()
-		_, e2 = io.Copy(conn, c)
+		tn.relay(b, a)
 	}()
 	wg.Wait()
+	return tn.err
+}
 
-	if e1 != nil && e2 != nil {
-		err = fmt.Errorf("two errors:\n%v\n%v\n", e1, e2)
-		return
+// dialSOCKS は pc の SOCKS プロキシを経由して host に接続する。
+// timeout が 0 より大きい場合、SOCKS のネゴシエーションも含めてその時間内に終わらなければ失敗とする。
+func dialSOCKS(host string, pc *config.Proxy, timeout time.Duration) (net.Conn, error) {
+	var auth *proxy.Auth
+	if pc.Username != "" || pc.Password != "" {
+		auth = &proxy.Auth{
+			User:     pc.Username,
+			Password: pc.Password,
+		}
 	}
-	if e1 != nil {
-		err = e1
-		return
+	fw := &net.Dialer{Timeout: timeout, KeepAlive: keepAlivePeriod}
+	d, err := proxy.SOCKS5("tcp", pc.Host+":"+strconv.Itoa(pc.SOCKSPort), auth, fw)
+	if err != nil {
+		return nil, err
 	}
-	if e2 != nil {
-		err = e2
-		return
+	if timeout <= 0 {
+		return d.Dial("tcp", host)
 	}
-	return
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial("tcp", host)
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// 遅れて繋がった接続は使わずに閉じる
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %s: timeout after %v", host, timeout)
+	}
+}
+
+// setKeepAlive は c が TCP 接続なら Keep-Alive を有効にする。
+func setKeepAlive(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(keepAlivePeriod)
+	}
+}
+
+// isTimeout は err が tunnel の時間制限によるものかを返す。
+func isTimeout(err error) bool {
+	return err == errIdleTimeout || err == errMaxDuration
+}
+
+// closeWriter は書き込み側だけを閉じることができる接続。
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// tunnel は2つの接続の間の中継の状態を管理する。
+type tunnel struct {
+	timeouts config.Timeouts
+	start    time.Time
+	last     int64 // 最後にどちらかの方向で通信があった時刻 (UnixNano)。atomic で操作する。
+	once     sync.Once
+	err      error // 中継を打ち切る原因になったエラー
+}
+
+// touch は通信があったことを記録する。
+func (tn *tunnel) touch() {
+	atomic.StoreInt64(&tn.last, time.Now().UnixNano())
+}
+
+// deadline は時間制限に従って次の読み書きの期限を返す。制限が無い場合はゼロ値を返す。
+func (tn *tunnel) deadline() time.Time {
+	var d time.Time
+	if tn.timeouts.Idle > 0 {
+		d = time.Unix(0, atomic.LoadInt64(&tn.last)).Add(tn.timeouts.Idle)
+	}
+	if tn.timeouts.MaxDuration > 0 {
+		if m := tn.start.Add(tn.timeouts.MaxDuration); d.IsZero() || m.Before(d) {
+			d = m
+		}
+	}
+	return d
+}
+
+// expired は期限切れが起きた時に、それが時間制限によるものかを判断する。
+// 反対方向の通信で期限が延びていた場合は nil を返す。
+func (tn *tunnel) expired() error {
+	now := time.Now()
+	if tn.timeouts.MaxDuration > 0 && now.Sub(tn.start) >= tn.timeouts.MaxDuration {
+		return errMaxDuration
+	}
+	if tn.timeouts.Idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&tn.last))) >= tn.timeouts.Idle {
+		return errIdleTimeout
+	}
+	return nil
+}
+
+// relay は src から dst へ中継する。
+// src が EOF になった場合は dst の書き込み側だけを閉じて相手に伝え、反対方向の中継は続ける。
+// エラーや時間制限で終わった場合は両方の接続を閉じて、もう片方の中継も終わらせる。
+func (tn *tunnel) relay(dst, src net.Conn) {
+	err := tn.copy(dst, src)
+	if err == nil {
+		cw, ok := dst.(closeWriter)
+		if !ok {
+			return
+		}
+		if err = cw.CloseWrite(); err == nil {
+			return
+		}
+	}
+	tn.abort(dst, src, err)
+}
+
+// abort は最初に起きたエラーを記録して両方の接続を閉じる。
+func (tn *tunnel) abort(a, b net.Conn, err error) {
+	tn.once.Do(func() {
+		tn.err = err
+		a.Close()
+		b.Close()
+	})
+}
+
+// copy は src から dst へ EOF まで書き写す。
+// 両方が TCP 接続の場合は ReadFrom を使い、Linux ではユーザー空間を経由せず splice(2) で転送させる。
+func (tn *tunnel) copy(dst, src net.Conn) error {
+	if d, ok := dst.(*net.TCPConn); ok {
+		if s, ok := src.(*net.TCPConn); ok {
+			return tn.splice(d, s)
+		}
+	}
+	return tn.copyBuffer(dst, src)
+}
+
+// limited は時間制限が設定されているかを返す。
+func (tn *tunnel) limited() bool {
+	return tn.timeouts.Idle > 0 || tn.timeouts.MaxDuration > 0
+}
+
+// splice は TCP 接続同士で src から dst へ EOF まで書き写す。
+// 時間制限がある場合は spliceChunk ごとに期限を設定し直す。
+// 書き込みの期限切れは転送途中のデータを失うため、書き込み側には max_duration だけを適用する。
+// 書き込みが詰まったまま無通信になった場合は反対方向の中継が idle_timeout で両方を閉じる。
+func (tn *tunnel) splice(dst, src *net.TCPConn) error {
+	if !tn.limited() {
+		_, err := dst.ReadFrom(src)
+		return err
+	}
+	if tn.timeouts.MaxDuration > 0 {
+		dst.SetWriteDeadline(tn.start.Add(tn.timeouts.MaxDuration))
+	}
+	for {
+		src.SetReadDeadline(tn.deadline())
+		n, err := dst.ReadFrom(io.LimitReader(src, spliceChunk))
+		if n > 0 {
+			tn.touch()
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if n > 0 {
+					continue
+				}
+				if e := tn.expired(); e != nil {
+					return e
+				}
+				continue
+			}
+			return err
+		}
+		// 上限に達する前に終わった場合は EOF
+		if n < spliceChunk {
+			return nil
+		}
+	}
+}
+
+// copyBuffer は src から dst へ EOF まで書き写す。時間制限がある場合は読み書きの度に期限を設定する。
+func (tn *tunnel) copyBuffer(dst, src net.Conn) error {
+	limited := tn.limited()
+	bp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bp)
+	buf := *bp
+	for {
+		if limited {
+			src.SetReadDeadline(tn.deadline())
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			tn.touch()
+			if werr := tn.write(dst, buf[:n], limited); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if e := tn.expired(); e != nil {
+					return e
+				}
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// write は b を全て dst に書き込む。期限切れが時間制限によるものでなければ書き込みを続ける。
+// *tls.Conn などは書き込みが期限切れになると以降の書き込みが全て失敗するため、素の TCP 接続以外には
+// splice と同じく max_duration だけを適用し、期限切れになったらそのまま終える。
+func (tn *tunnel) write(dst net.Conn, b []byte, limited bool) error {
+	_, raw := dst.(*net.TCPConn)
+	for len(b) > 0 {
+		if limited {
+			if raw {
+				dst.SetWriteDeadline(tn.deadline())
+			} else if tn.timeouts.MaxDuration > 0 {
+				dst.SetWriteDeadline(tn.start.Add(tn.timeouts.MaxDuration))
+			}
+		}
+		n, err := dst.Write(b)
+		if n > 0 {
+			tn.touch()
+			b = b[n:]
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if !raw {
+					return errMaxDuration
+				}
+				if e := tn.expired(); e != nil {
+					return e
+				}
+				continue
+			}
+			return err
+		}
+	}
+	return nil
 }
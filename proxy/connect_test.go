@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// plainConn は *net.TCPConn を隠して copyBuffer で中継させるための接続。CloseWrite はそのまま使える。
+type plainConn struct {
+	net.Conn
+}
+
+func (c plainConn) CloseWrite() error {
+	return c.Conn.(closeWriter).CloseWrite()
+}
+
+// pipeWith は t の時間制限で pipe を使って中継する関数を返す。wrap が true の場合は中継する接続を plainConn で包む。
+func pipeWith(t config.Timeouts, wrap bool) func(a, b net.Conn) error {
+	return func(a, b net.Conn) error {
+		if wrap {
+			return pipe(plainConn{a}, plainConn{b}, t)
+		}
+		return pipe(a, b, t)
+	}
+}
+
+// relayed はループバックの TCP 接続を relay で中継し、クライアント側とサーバ側の接続を返す。
+// relay の結果は done に送られる。
+func relayed(tb testing.TB, relay func(a, b net.Conn) error) (client, server *net.TCPConn, done <-chan error) {
+	tb.Helper()
+	lnServer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer lnServer.Close()
+	lnRelay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer lnRelay.Close()
+
+	ch := make(chan error, 1)
+	go func() {
+		a, err := lnRelay.Accept()
+		if err != nil {
+			ch <- err
+			return
+		}
+		b, err := net.Dial("tcp", lnServer.Addr().String())
+		if err != nil {
+			a.Close()
+			ch <- err
+			return
+		}
+		err = relay(a, b)
+		a.Close()
+		b.Close()
+		ch <- err
+	}()
+
+	c, err := net.Dial("tcp", lnRelay.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := lnServer.Accept()
+	if err != nil {
+		c.Close()
+		tb.Fatal(err)
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn), ch
+}
+
+var pipeCases = []struct {
+	name     string
+	timeouts config.Timeouts
+	wrap     bool
+}{
+	{"splice", config.Timeouts{}, false},
+	{"splice-limited", config.Timeouts{Idle: 5 * time.Second, MaxDuration: time.Minute}, false},
+	{"copyBuffer", config.Timeouts{}, true},
+	{"copyBuffer-limited", config.Timeouts{Idle: 5 * time.Second, MaxDuration: time.Minute}, true},
+}
+
+// TestPipeHalfClose はクライアントが書き込み側を閉じた後も、サーバからの応答が届くことを確かめる。
+// サーバはエコーサーバで、EOF を受け取ってから後書きを送って接続を閉じる。
+func TestPipeHalfClose(t *testing.T) {
+	for _, tc := range pipeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server, done := relayed(t, pipeWith(tc.timeouts, tc.wrap))
+			defer client.Close()
+
+			serverErr := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				server.SetDeadline(time.Now().Add(5 * time.Second))
+				// クライアントの EOF が届かなければ io.Copy は期限切れまで終わらない
+				if _, err := io.Copy(server, server); err != nil {
+					serverErr <- err
+					return
+				}
+				_, err := server.Write([]byte(" bye"))
+				serverErr <- err
+			}()
+
+			if _, err := client.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), "hello bye"; got != want {
+				t.Errorf("client received %q, want %q", got, want)
+			}
+			if err := <-serverErr; err != nil {
+				t.Errorf("server: %v", err)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("pipe: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("pipe did not finish after both sides closed")
+			}
+		})
+	}
+}
+
+// TestWriteTLSStalled は TLS の接続への書き込みが idle_timeout より長く詰まっても、
+// 反対方向に通信が続いていれば接続を壊さずに書き込みを終えることを確かめる。
+func TestWriteTLSStalled(t *testing.T) {
+	cert, err := SelfSignedCertificate([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	dst := tls.Client(a, &tls.Config{InsecureSkipVerify: true})
+	server := tls.Server(b, &tls.Config{Certificates: []tls.Certificate{*cert}, SessionTicketsDisabled: true})
+	received := make(chan []byte, 1)
+	go func() {
+		if err := server.Handshake(); err != nil {
+			received <- nil
+			return
+		}
+		// idle_timeout を過ぎるまで読まずに書き込みを詰まらせる
+		time.Sleep(300 * time.Millisecond)
+		b, _ := io.ReadAll(server)
+		received <- b
+	}()
+	if err := dst.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	tn := &tunnel{timeouts: config.Timeouts{Idle: 100 * time.Millisecond}, start: time.Now()}
+	tn.touch()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// 反対方向の通信
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				tn.touch()
+			}
+		}
+	}()
+
+	data := bytes.Repeat([]byte("x"), 64*1024)
+	werr := make(chan error, 1)
+	go func() { werr <- tn.write(dst, data, true) }()
+	select {
+	case err := <-werr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		a.Close()
+		t.Fatal("write did not finish")
+	}
+	dst.Close()
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("server received %d bytes, want %d", len(got), len(data))
+	}
+}
+
+// readWriter は Read と Write だけを公開し、io.Copy に ReadFrom や WriteTo (splice) を使わせないための型。
+type readWriter struct {
+	io.ReadWriter
+}
+
+// copyBoth は splice や時間制限を導入する前の、2つの io.Copy でユーザー空間のバッファを介して中継する実装。
+// ベンチマークの比較に使う。
+func copyBoth(a, b net.Conn) error {
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(readWriter{a}, readWriter{b})
+		a.(*net.TCPConn).CloseWrite()
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(readWriter{b}, readWriter{a})
+		b.(*net.TCPConn).CloseWrite()
+		done <- err
+	}()
+	err := <-done
+	if e := <-done; err == nil {
+		err = e
+	}
+	return err
+}
+
+// BenchmarkPipe はループバックの TCP 接続でクライアントからサーバへ中継する速度を測る。
+// CPU の使用量は -cpuprofile などで比較する。
+func BenchmarkPipe(b *testing.B) {
+	names := []string{"io.Copy"}
+	relays := []func(a, b net.Conn) error{copyBoth}
+	for _, tc := range pipeCases {
+		names = append(names, tc.name)
+		relays = append(relays, pipeWith(tc.timeouts, tc.wrap))
+	}
+	for i, name := range names {
+		relay := relays[i]
+		b.Run(name, func(b *testing.B) {
+			client, server, done := relayed(b, relay)
+			defer client.Close()
+			received := make(chan int64, 1)
+			go func() {
+				n, _ := io.Copy(io.Discard, server)
+				server.Close()
+				received <- n
+			}()
+
+			buf := make([]byte, 256*1024)
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			client.CloseWrite()
+			if n := <-received; n != int64(len(buf))*int64(b.N) {
+				b.Errorf("server received %d bytes, want %d", n, len(buf)*b.N)
+			}
+			b.StopTimer()
+			<-done
+		})
+	}
+}
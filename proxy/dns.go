@@ -0,0 +1,553 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+const (
+	dnsTimeout   = 5 * time.Second // ひとつの問い合わせにかける最大時間
+	dnsCacheSize = 4096            // キャッシュする応答の最大数
+	dnsUDPSize   = 512             // EDNS0 を使わない UDP の応答の最大長
+	dnsStaticTTL = 60              // [hosts] の名前に応答する際の TTL
+)
+
+// DNS は UDP と TCP で DNS の問い合わせを受け付け、上流の SOCKS プロキシを経由して DNS サーバへ TCP で転送する。
+// 応答は TTL の間キャッシュする。
+type DNS struct {
+	Logger       *log.Logger
+	DrainTimeout time.Duration       // Close の際に処理中の TCP 接続の完了を待つ最大時間
+	Timeouts     config.Timeouts     // Dial を上流への接続の時間制限に使う
+	DirectHosts  map[string]struct{} // ここに含まれる名前は上流を経由せずに DirectServer に問い合わせる
+	DirectServer string              // 空の場合は /etc/resolv.conf の nameserver を使う
+	Resolver     *Resolver           // [hosts] の名前には自分で応答し、手元で名前解決する名前は DirectServer に問い合わせる
+	Cache        *DNSCache           // 応答のキャッシュ。nil の場合はこのサーバだけで使うものを作成する
+	server       string
+	proxy        *config.Proxy
+	udp          net.PacketConn
+	tcp          net.Listener
+	conns        *tracker
+	closed       chan struct{}
+}
+
+// NewDNS は新しい DNS サーバを作成する。server には上流の向こう側の DNS サーバを "10.0.0.53:53" の形式で渡す。
+// 実際に使用するプロキシ設定は proxy で指定する。
+func NewDNS(server string, proxy *config.Proxy) *DNS {
+	return &DNS{
+		Logger:       log.New(os.Stderr, "", log.LstdFlags),
+		DrainTimeout: 1 * time.Second,
+		server:       server,
+		proxy:        proxy,
+		conns:        newTracker(),
+		closed:       make(chan struct{}),
+	}
+}
+
+// ListenAndServe は addr の UDP と TCP で Listen して問い合わせの待受状態に入る。
+// Listen が成功したかどうかを errch を通じて返し、Serve の結果は Logger を経由して出力する。
+func (srv *DNS) ListenAndServe(addr string, errch chan<- error) {
+	udp, err := listenPacket(addr)
+	if err != nil {
+		errch <- err
+		return
+	}
+	tcp, err := listen(addr, config.SocketOptions{UID: -1, GID: -1})
+	if err != nil {
+		udp.Close()
+		errch <- err
+		return
+	}
+	srv.udp, srv.tcp = udp, tcp
+	if srv.DirectServer == "" {
+		srv.DirectServer = systemResolver()
+	}
+	if srv.Cache == nil {
+		srv.Cache = NewDNSCache(srv.server)
+	}
+	errch <- nil
+
+	go srv.serveUDP()
+	srv.serveTCP()
+	close(srv.closed)
+}
+
+// Close は Listen を終了し、処理中の接続が完了するのを DrainTimeout まで待つ。
+func (srv *DNS) Close() error {
+	return srv.Shutdown(srv.DrainTimeout)
+}
+
+// Shutdown は Listen を終了して新しい問い合わせの受付を止め、処理中の TCP 接続が完了するのを最大 timeout まで待つ。
+func (srv *DNS) Shutdown(timeout time.Duration) error {
+	srv.udp.Close()
+	err := srv.tcp.Close()
+	<-srv.closed
+	if n := srv.conns.drain(timeout); n > 0 {
+		srv.Logger.Printf("%s: closed %d DNS connections after %v", srv.tcp.Addr(), n, timeout)
+	}
+	return err
+}
+
+// serveUDP は UDP で受け取った問い合わせをそれぞれ別の goroutine で処理する。
+func (srv *DNS) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := srv.udp.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		q := make([]byte, n)
+		copy(q, buf[:n])
+		go func() {
+			resp := srv.answer(q)
+			if resp == nil {
+				return
+			}
+			if max := udpSize(q); len(resp) > max {
+				resp = truncate(resp)
+			}
+			srv.udp.WriteTo(resp, addr)
+		}()
+	}
+}
+
+// serveTCP は TCP の接続を受け付ける。
+func (srv *DNS) serveTCP() {
+	for {
+		c, err := srv.tcp.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		srv.conns.add(c)
+		go srv.serveTCPConn(c)
+	}
+}
+
+// serveTCPConn はひとつの TCP 接続で送られてくる問い合わせを順に処理する。
+func (srv *DNS) serveTCPConn(c net.Conn) {
+	defer func() {
+		c.Close()
+		srv.conns.remove(c)
+	}()
+	for {
+		c.SetReadDeadline(time.Now().Add(2 * dnsTimeout))
+		q, err := readTCPMessage(c)
+		if err != nil {
+			return
+		}
+		resp := srv.answer(q)
+		if resp == nil {
+			return
+		}
+		if err = writeTCPMessage(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// answer は問い合わせ q への応答を返す。問い合わせとして解釈できない場合は nil を返す。
+func (srv *DNS) answer(q []byte) []byte {
+	name, end, ok := parseQuestion(q)
+	if !ok {
+		return nil
+	}
+	host := strings.TrimSuffix(name, ".")
+	if ip := srv.Resolver.static(host); ip != nil {
+		return staticAnswer(q, end, ip)
+	}
+	// 名前の大文字と小文字は区別せず、種類とクラスごとにキャッシュする
+	key := name + string(q[end-4:end])
+	if resp := srv.Cache.get(key, q[:end]); resp != nil {
+		return resp
+	}
+
+	var resp []byte
+	var err error
+	_, direct := srv.DirectHosts[host]
+	switch mode := srv.Resolver.Mode(host); {
+	case direct || mode == config.ResolveLocal:
+		resp, err = exchangeDirect(srv.DirectServer, q)
+	case mode == config.ResolveLocalThenRemote:
+		resp, err = exchangeDirect(srv.DirectServer, q)
+		if err != nil || resp[3]&0x0f != 0 || binary.BigEndian.Uint16(resp[6:]) == 0 {
+			resp, err = srv.exchangeSOCKS(q)
+		}
+	default:
+		resp, err = srv.exchangeSOCKS(q)
+	}
+	if err != nil {
+		srv.Logger.Printf("dns: %s: %v", name, err)
+		return servFail(q)
+	}
+	srv.Cache.put(key, resp)
+	return resp
+}
+
+// exchangeSOCKS は上流の SOCKS プロキシを経由して DNS サーバに TCP で問い合わせる。
+func (srv *DNS) exchangeSOCKS(q []byte) ([]byte, error) {
+	timeout := srv.Timeouts.Dial
+	if timeout <= 0 || timeout > dnsTimeout {
+		timeout = dnsTimeout
+	}
+	c, err := dialSOCKS(srv.server, srv.proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return exchangeTCP(c, q)
+}
+
+// exchangeDirect は server に UDP で問い合わせ、応答が切り詰められていれば TCP で問い合わせ直す。
+func exchangeDirect(server string, q []byte) ([]byte, error) {
+	c, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err = c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 別の問い合わせへの応答は無視する
+		if n < 12 || buf[0] != q[0] || buf[1] != q[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break
+	}
+
+	tc, err := net.DialTimeout("tcp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+	return exchangeTCP(tc, q)
+}
+
+// exchangeTCP は c に問い合わせ q を送り、その応答を返す。
+func exchangeTCP(c net.Conn, q []byte) ([]byte, error) {
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := writeTCPMessage(c, q); err != nil {
+		return nil, err
+	}
+	resp, err := readTCPMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 || resp[0] != q[0] || resp[1] != q[1] {
+		return nil, errors.New("mismatched DNS response")
+	}
+	return resp, nil
+}
+
+// readTCPMessage は長さが前置された DNS メッセージをひとつ読む。
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	m := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeTCPMessage は DNS メッセージ m を長さを前置して書き込む。
+func writeTCPMessage(w io.Writer, m []byte) error {
+	b := make([]byte, 2+len(m))
+	binary.BigEndian.PutUint16(b, uint16(len(m)))
+	copy(b[2:], m)
+	_, err := w.Write(b)
+	return err
+}
+
+// systemResolver は /etc/resolv.conf に記述された最初の nameserver を返す。
+func systemResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// parseQuestion は問い合わせ q の質問部を読み、問い合わせている名前と質問部の終わりの位置を返す。
+func parseQuestion(q []byte) (name string, end int, ok bool) {
+	// 応答や質問がひとつでないものは扱わない
+	if len(q) < 12 || q[2]&0x80 != 0 || binary.BigEndian.Uint16(q[4:]) != 1 {
+		return "", 0, false
+	}
+	var labels []string
+	off := 12
+	for {
+		if off >= len(q) {
+			return "", 0, false
+		}
+		l := int(q[off])
+		if l == 0 {
+			off++
+			break
+		}
+		if l&0xc0 != 0 || off+1+l > len(q) {
+			return "", 0, false
+		}
+		labels = append(labels, string(q[off+1:off+1+l]))
+		off += 1 + l
+	}
+	if off+4 > len(q) {
+		return "", 0, false
+	}
+	return strings.ToLower(strings.Join(labels, ".")) + ".", off + 4, true
+}
+
+// skipName は off から始まる名前の次の位置を返す。
+func skipName(m []byte, off int) (int, bool) {
+	for {
+		if off >= len(m) {
+			return 0, false
+		}
+		l := int(m[off])
+		switch {
+		case l == 0:
+			return off + 1, true
+		case l&0xc0 == 0xc0:
+			if off+2 > len(m) {
+				return 0, false
+			}
+			return off + 2, true
+		case l&0xc0 != 0:
+			return 0, false
+		}
+		off += 1 + l
+	}
+}
+
+// records は m の応答部以降のリソースレコードを順に f に渡す。off は各レコードの種類の位置。
+func records(m []byte, f func(typ uint16, off int)) bool {
+	if len(m) < 12 {
+		return false
+	}
+	qd := int(binary.BigEndian.Uint16(m[4:]))
+	rr := int(binary.BigEndian.Uint16(m[6:])) + int(binary.BigEndian.Uint16(m[8:])) + int(binary.BigEndian.Uint16(m[10:]))
+	off := 12
+	var ok bool
+	for i := 0; i < qd; i++ {
+		if off, ok = skipName(m, off); !ok || off+4 > len(m) {
+			return false
+		}
+		off += 4
+	}
+	for i := 0; i < rr; i++ {
+		if off, ok = skipName(m, off); !ok || off+10 > len(m) {
+			return false
+		}
+		f(binary.BigEndian.Uint16(m[off:]), off)
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:]))
+		if off > len(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// udpSize は問い合わせ q の送信元が UDP で受け取れる応答の長さを返す。
+func udpSize(q []byte) int {
+	size := dnsUDPSize
+	records(q, func(typ uint16, off int) {
+		// OPT レコードのクラスは受け取れる長さを表す
+		if typ == 41 {
+			if n := int(binary.BigEndian.Uint16(q[off+2:])); n > size {
+				size = n
+			}
+		}
+	})
+	return size
+}
+
+// truncate は応答を質問部だけにして TC ビットを立て、TCP で問い合わせ直すよう促す。
+func truncate(resp []byte) []byte {
+	off, ok := skipName(resp, 12)
+	if !ok || off+4 > len(resp) {
+		return resp[:12]
+	}
+	t := append([]byte(nil), resp[:off+4]...)
+	t[2] |= 0x02
+	binary.BigEndian.PutUint16(t[4:], 1)
+	for i := 6; i < 12; i++ {
+		t[i] = 0
+	}
+	return t
+}
+
+// servFail は問い合わせ q に対する SERVFAIL の応答を作る。
+func servFail(q []byte) []byte {
+	resp := truncate(q)
+	resp[2] = resp[2]&^0x02 | 0x80
+	resp[3] = resp[3]&0xf0 | 0x80 | 2
+	return resp
+}
+
+// staticAnswer は [hosts] に記述された ip で問い合わせ q に応答する。q は質問部の終わりまでを渡す。
+// 問い合わせの種類が IP アドレスの種類と合わない場合は応答部を空にする。
+func staticAnswer(q []byte, end int, ip net.IP) []byte {
+	resp := append([]byte(nil), q[:end]...)
+	resp[2] = 0x80 | 0x04 | q[2]&0x01 // QR, AA, RD
+	resp[3] = 0x80                    // RA
+	for i := 6; i < 12; i++ {
+		resp[i] = 0
+	}
+
+	var typ uint16
+	var rdata []byte
+	switch qtype := binary.BigEndian.Uint16(q[end-4:]); {
+	case qtype == 1 && ip.To4() != nil:
+		typ, rdata = 1, ip.To4()
+	case qtype == 28 && ip.To4() == nil:
+		typ, rdata = 28, ip.To16()
+	default:
+		return resp
+	}
+	rr := make([]byte, 12, 12+len(rdata))
+	rr[0], rr[1] = 0xc0, 12 // 質問部の名前を指す
+	binary.BigEndian.PutUint16(rr[2:], typ)
+	binary.BigEndian.PutUint16(rr[4:], 1)
+	binary.BigEndian.PutUint32(rr[6:], dnsStaticTTL)
+	binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	return append(resp, append(rr, rdata...)...)
+}
+
+// DNSCache は DNS の応答を TTL の間保持する。全ての DNS サーバで共有し、設定の再読み込みをまたいで使いまわす。
+type DNSCache struct {
+	server  string // 応答を問い合わせた上流の向こう側の DNS サーバ
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	resp    []byte
+	ttls    []int // resp の中の TTL の位置
+	stored  time.Time
+	expires time.Time
+}
+
+// NewDNSCache は上流の向こう側の DNS サーバ server の応答を保持するキャッシュを作成する。
+func NewDNSCache(server string) *DNSCache {
+	return &DNSCache{server: server, entries: make(map[string]*dnsEntry)}
+}
+
+// Matches は c が server の応答を保持するキャッシュかを返す。
+func (c *DNSCache) Matches(server string) bool {
+	return c.server == server
+}
+
+// get はキャッシュしている応答を、ID と質問部を問い合わせ q に合わせ、TTL を経過した時間だけ減らして返す。
+// q は質問部の終わりまでを渡す。
+func (c *DNSCache) get(key string, q []byte) []byte {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !time.Now().Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	resp := append([]byte(nil), e.resp...)
+	// 名前の大文字と小文字を問い合わせと揃える
+	copy(resp, q[:2])
+	copy(resp[12:], q[12:])
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	for _, off := range e.ttls {
+		ttl := binary.BigEndian.Uint32(resp[off:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(resp[off:], ttl)
+	}
+	return resp
+}
+
+// put は応答に含まれる TTL の最小値の間 resp を保持する。正常な応答と NXDOMAIN 以外は保持しない。
+func (c *DNSCache) put(key string, resp []byte) {
+	if len(resp) < 12 || resp[2]&0x02 != 0 {
+		return
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 && rcode != 3 {
+		return
+	}
+	var ttls []int
+	var min uint32
+	ok := records(resp, func(typ uint16, off int) {
+		if typ == 41 {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(resp[off+4:])
+		if len(ttls) == 0 || ttl < min {
+			min = ttl
+		}
+		ttls = append(ttls, off+4)
+	})
+	if !ok || len(ttls) == 0 || min == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// 期限切れのものが無ければ任意のひとつを捨てる
+		for k := range c.entries {
+			if len(c.entries) < dnsCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &dnsEntry{
+		resp:    append([]byte(nil), resp...),
+		ttls:    ttls,
+		stored:  now,
+		expires: now.Add(time.Duration(min) * time.Second),
+	}
+}
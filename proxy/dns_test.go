@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// fakeDNS は全ての問い合わせに 192.0.2.1 (TTL 300) で応答する DNS サーバ。UDP と TCP の問い合わせの数を数える。
+type fakeDNS struct {
+	udp      net.PacketConn
+	tcp      net.Listener
+	udpCount int32
+	tcpCount int32
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// UDP と同じポート番号の TCP で待ち受ける
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Fatal(err)
+	}
+	d := &fakeDNS{udp: udp, tcp: tcp}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&d.udpCount, 1)
+			udp.WriteTo(fakeAnswer(buf[:n]), addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				q, err := readTCPMessage(c)
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&d.tcpCount, 1)
+				writeTCPMessage(c, fakeAnswer(q))
+			}()
+		}
+	}()
+	return d
+}
+
+func (d *fakeDNS) addr() string {
+	return d.udp.LocalAddr().String()
+}
+
+func (d *fakeDNS) Close() {
+	d.udp.Close()
+	d.tcp.Close()
+}
+
+// fakeAnswer は問い合わせ q に 192.0.2.1 で応答する。
+func fakeAnswer(q []byte) []byte {
+	_, end, ok := parseQuestion(q)
+	if !ok {
+		return servFail(q)
+	}
+	resp := append([]byte(nil), q[:end]...)
+	resp[2], resp[3] = 0x81, 0x80
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	return append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0x01, 0x2c, 0, 4, 192, 0, 2, 1)
+}
+
+// startSOCKS は認証なしの CONNECT だけを扱う SOCKS5 サーバを起動し、そのリスナーを返す。
+func startSOCKS(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSOCKS(c)
+		}
+	}()
+	return l
+}
+
+func serveFakeSOCKS(c net.Conn) {
+	defer c.Close()
+	b := make([]byte, 256)
+	// 挨拶
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+	// 接続要求
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 1:
+		if _, err := io.ReadFull(c, b[:4]); err != nil {
+			return
+		}
+		host = net.IP(b[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(c, b[:1]); err != nil {
+			return
+		}
+		n := int(b[0])
+		if _, err := io.ReadFull(c, b[:n]); err != nil {
+			return
+		}
+		host = string(b[:n])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b[:2])))
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer conn.Close()
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(conn, c)
+	io.Copy(c, conn)
+}
+
+// dnsQuery は name の A レコードの問い合わせを作る。
+func dnsQuery(name string) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, l := range strings.Split(name, ".") {
+		q = append(q, byte(len(l)))
+		q = append(q, l...)
+	}
+	return append(q, 0, 0, 1, 0, 1)
+}
+
+// answerIP は応答の最後の A レコードの IP アドレスを返す。
+func answerIP(t *testing.T, resp []byte) string {
+	t.Helper()
+	if len(resp) < 12 || resp[3]&0x0f != 0 || binary.BigEndian.Uint16(resp[6:]) == 0 {
+		t.Fatalf("unexpected response % x", resp)
+	}
+	return net.IP(resp[len(resp)-4:]).String()
+}
+
+// startDNS は srv を起動し、UDP と TCP で問い合わせる関数を返す。
+func startDNS(t *testing.T, srv *DNS) (udp, tcp func(name string) []byte) {
+	srv.Logger.SetOutput(io.Discard)
+	errch := make(chan error, 1)
+	go srv.ListenAndServe("127.0.0.1:0", errch)
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	udp = func(name string) []byte {
+		c, err := net.Dial("udp", srv.udp.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = c.Write(dnsQuery(name)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 512)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	tcp = func(name string) []byte {
+		c, err := net.Dial("tcp", srv.tcp.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		resp, err := exchangeTCP(c, dnsQuery(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	return udp, tcp
+}
+
+// TestDNS は問い合わせが SOCKS を経由して DNS サーバへ TCP で転送され、応答がキャッシュされることを確かめる。
+// direct_hosts の名前は DirectServer に、[hosts] の名前には自分で応答する。
+func TestDNS(t *testing.T) {
+	upstream := newFakeDNS(t)
+	defer upstream.Close()
+	direct := newFakeDNS(t)
+	defer direct.Close()
+	socks := startSOCKS(t)
+	defer socks.Close()
+
+	pc := &config.Proxy{Host: "127.0.0.1", SOCKSPort: socks.Addr().(*net.TCPAddr).Port}
+	newServer := func(cache *DNSCache) *DNS {
+		srv := NewDNS(upstream.addr(), pc)
+		srv.DirectServer = direct.addr()
+		srv.DirectHosts = map[string]struct{}{"direct.example": {}}
+		srv.Resolver = NewResolver(map[string]net.IP{"pinned.example": net.ParseIP("198.51.100.7")}, nil, config.ResolveRemote)
+		srv.Cache = cache
+		return srv
+	}
+	cache := NewDNSCache(upstream.addr())
+	srv := newServer(cache)
+	udp, tcp := startDNS(t, srv)
+
+	if ip := answerIP(t, udp("remote.example")); ip != "192.0.2.1" {
+		t.Errorf("remote.example: got %s", ip)
+	}
+	if n := atomic.LoadInt32(&upstream.tcpCount); n != 1 {
+		t.Errorf("upstream received %d TCP queries, want 1", n)
+	}
+	// 2回目はキャッシュから返す
+	answerIP(t, tcp("remote.example"))
+	if n := atomic.LoadInt32(&upstream.tcpCount); n != 1 {
+		t.Errorf("upstream received %d TCP queries after a cached query, want 1", n)
+	}
+
+	if ip := answerIP(t, udp("direct.example")); ip != "192.0.2.1" {
+		t.Errorf("direct.example: got %s", ip)
+	}
+	if n := atomic.LoadInt32(&direct.udpCount); n != 1 {
+		t.Errorf("direct server received %d UDP queries, want 1", n)
+	}
+
+	if ip := answerIP(t, udp("pinned.example")); ip != "198.51.100.7" {
+		t.Errorf("pinned.example: got %s", ip)
+	}
+	if n := atomic.LoadInt32(&upstream.tcpCount) + atomic.LoadInt32(&direct.udpCount); n != 2 {
+		t.Errorf("pinned name was forwarded (%d queries in total)", n)
+	}
+
+	// 設定の再読み込みで作り直したサーバも同じキャッシュを使う
+	srv.Close()
+	srv = newServer(cache)
+	udp, _ = startDNS(t, srv)
+	defer srv.Close()
+	answerIP(t, udp("remote.example"))
+	if n := atomic.LoadInt32(&upstream.tcpCount); n != 1 {
+		t.Errorf("upstream received %d TCP queries after reload, want 1", n)
+	}
+}
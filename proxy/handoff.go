@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	handoffEnv      = "PROXY_RELAY_HANDOFF"       // 起動の完了を元のプロセスに通知するパイプのファイルディスクリプタ
+	handoffNamesEnv = "PROXY_RELAY_HANDOFF_NAMES" // 引き継いだソケットの名前。アドレスに ":" を含むため改行で区切る
+)
+
+// filer はファイルディスクリプタを複製できるソケット。
+type filer interface {
+	File() (*os.File, error)
+}
+
+var (
+	socketsMu sync.Mutex
+	sockets   = make(map[string]filer) // listen と listenPacket で開いているソケット。名前は待ち受けるアドレス
+	handoffW  *os.File                 // Handoff で起動された場合に起動の完了を通知するパイプ
+)
+
+// trackedListener は Close されるまで Handoff で引き継ぐ対象として記録される net.Listener。
+type trackedListener struct {
+	net.Listener
+	name string
+}
+
+func (l *trackedListener) Close() error {
+	forget(l.name, l.Listener)
+	return l.Listener.Close()
+}
+
+// trackedPacketConn は Close されるまで Handoff で引き継ぐ対象として記録される net.PacketConn。
+type trackedPacketConn struct {
+	net.PacketConn
+	name string
+}
+
+func (c *trackedPacketConn) Close() error {
+	forget(c.name, c.PacketConn)
+	return c.PacketConn.Close()
+}
+
+// track は name で開いたソケット s を Handoff で引き継ぐ対象として記録する。
+func track(name string, s interface{}) {
+	f, ok := s.(filer)
+	if !ok {
+		return
+	}
+	socketsMu.Lock()
+	sockets[name] = f
+	socketsMu.Unlock()
+}
+
+// forget は name のソケットが s であれば記録から取り除く。
+func forget(name string, s interface{}) {
+	socketsMu.Lock()
+	if f, ok := sockets[name]; ok && f == s {
+		delete(sockets, name)
+	}
+	socketsMu.Unlock()
+}
+
+// Handoff は実行中のプログラムを同じ引数で起動し直し、listen と listenPacket で開いている全てのソケットを引き継がせる。
+// 新しいプロセスが HandoffReady を呼ぶまで最大 timeout 待ち、そのプロセス ID を返す。
+// 成功した後は Unix ソケットを閉じてもファイルを削除しないため、呼び出し側は処理中の接続を待ってから終了すればよい。
+func Handoff(timeout time.Duration) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	socketsMu.Lock()
+	defer socketsMu.Unlock()
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for name, s := range sockets {
+		f, err := s.File()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		files = append(files, f)
+		names = append(names, name)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(handoffEnviron(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		handoffNamesEnv+"="+strings.Join(names, "\n"),
+		handoffEnv+"="+strconv.Itoa(listenFdsStart+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// 新しいプロセスは起動が完了するとパイプに書き込み、失敗して終了した場合は何も書き込まずにパイプが閉じられる
+	ready := make(chan bool, 1)
+	go func() {
+		var b [1]byte
+		n, _ := r.Read(b[:])
+		ready <- n > 0
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			return 0, fmt.Errorf("new process exited: %v", cmd.Wait())
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("new process did not become ready in %v", timeout)
+	}
+
+	for _, s := range sockets {
+		if l, ok := s.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Pid, nil
+}
+
+// handoffEnviron は Handoff で起動するプロセスに渡す環境変数を返す。
+// ソケットの受け渡しに使う変数と、元のプロセスを指す WATCHDOG_PID は取り除く。
+func handoffEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch kv[:strings.Index(kv, "=")+1] {
+		case "LISTEN_PID=", "LISTEN_FDS=", "LISTEN_FDNAMES=", "WATCHDOG_PID=", handoffEnv + "=", handoffNamesEnv + "=":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// HandoffReady は Handoff で起動された場合に、起動が完了したことを元のプロセスに通知する。
+// Handoff で起動されたのでなければ何もせずに false を返す。
+func HandoffReady() (bool, error) {
+	if handoffW == nil {
+		return false, nil
+	}
+	_, err := handoffW.Write([]byte{1})
+	handoffW.Close()
+	handoffW = nil
+	if err != nil {
+		return true, errors.New("handoff: " + err.Error())
+	}
+	return true, nil
+}
@@ -0,0 +1,183 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// handoffTestEnv は TestHandoff で起動し直したプロセスに、引き継ぐソケットの名前と実際のアドレスを "name=addr" の行で渡す環境変数。
+// "fail" の場合は起動の完了を通知せずに終了する。
+const handoffTestEnv = "PROXY_RELAY_TEST_HANDOFF"
+
+// TestHandoff は Handoff で起動したプロセスが全てのソケットを引き継ぎ、元のプロセスが閉じた後の接続を受け付けることを確かめる。
+func TestHandoff(t *testing.T) {
+	if v := os.Getenv(handoffTestEnv); v != "" {
+		handoffChild(t, v)
+		return
+	}
+	if ok, err := HandoffReady(); ok || err != nil {
+		t.Fatalf("HandoffReady without Handoff = %v, %v", ok, err)
+	}
+
+	opt := config.SocketOptions{UID: -1, GID: -1}
+	sock := filepath.Join(t.TempDir(), "http.sock")
+	tcp, err := listen("127.0.0.1:0", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	unix, err := listen("unix:"+sock, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	udp, err := listenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	// 起動し直すプロセスではこのテストだけを実行させ、出力はテストの結果に含めない
+	args, stdout, stderr := os.Args, os.Stdout, os.Stderr
+	defer func() { os.Args, os.Stdout, os.Stderr = args, stdout, stderr }()
+	os.Args = []string{args[0], "-test.run=^TestHandoff$", "-test.timeout=1m"}
+	dir := t.TempDir()
+	capture := func(name string) func() string {
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { out.Close() })
+		os.Stdout, os.Stderr = out, out
+		return func() string {
+			b, _ := os.ReadFile(out.Name())
+			return string(b)
+		}
+	}
+
+	// 起動が完了する前に終了した場合
+	capture("fail")
+	t.Setenv(handoffTestEnv, "fail")
+	if _, err := Handoff(time.Minute); err == nil || !strings.Contains(err.Error(), "new process exited") {
+		t.Errorf("Handoff to a failing process = %v, want an exit error", err)
+	}
+
+	t.Setenv(handoffTestEnv, strings.Join([]string{
+		"127.0.0.1:0=" + tcp.Addr().String(),
+		"unix:" + sock + "=unix:" + sock,
+		"udp:127.0.0.1:0=" + udp.LocalAddr().String(),
+	}, "\n"))
+	output := capture("out")
+	pid, err := Handoff(time.Minute)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output())
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Kill()
+
+	// 元のプロセスが閉じても Unix ソケットのファイルは残り、新しいプロセスが接続を受け付ける
+	tcp.Close()
+	unix.Close()
+	udp.Close()
+	for _, a := range []struct{ network, addr string }{{"tcp", tcp.Addr().String()}, {"unix", sock}, {"udp", udp.LocalAddr().String()}} {
+		c, err := net.DialTimeout(a.network, a.addr, 5*time.Second)
+		if err != nil {
+			t.Errorf("%s %s: %v", a.network, a.addr, err)
+			continue
+		}
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		c.Write([]byte("ping\n"))
+		if line, err := bufio.NewReader(c).ReadString('\n'); line != "pong\n" {
+			t.Errorf("%s %s: got %q, %v", a.network, a.addr, line, err)
+		}
+		c.Close()
+	}
+
+	if t.Failed() {
+		p.Kill()
+	}
+	if st, err := p.Wait(); err != nil || !st.Success() {
+		t.Errorf("new process: %v %v\n%s", st, err, output())
+	}
+}
+
+// handoffChild は TestHandoff で Handoff によって起動されたプロセスで、引き継いだソケットで待ち受けて "ping" に "pong" と応答する。
+func handoffChild(t *testing.T, v string) {
+	n, err := InheritListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == "fail" {
+		t.Fatal("exiting without HandoffReady")
+	}
+	if os.Getenv(handoffEnv) != "" || os.Getenv(handoffNamesEnv) != "" {
+		t.Error("handoff variables were not unset")
+	}
+
+	var ls []net.Listener
+	var pc net.PacketConn
+	lines := strings.Split(v, "\n")
+	if n < len(lines) {
+		t.Fatalf("InheritListeners = %d, want at least %d", n, len(lines))
+	}
+	for _, line := range lines {
+		i := strings.Index(line, "=")
+		name, want := line[:i], line[i+1:]
+		if strings.HasPrefix(name, "udp:") {
+			c, err := listenPacket(strings.TrimPrefix(name, "udp:"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.LocalAddr().String(); got != want {
+				t.Fatalf("listenPacket(%s) = %s, want %s", name, got, want)
+			}
+			pc = c
+			continue
+		}
+		l, err := listen(name, config.SocketOptions{UID: -1, GID: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := listenerAddr(l); got != want {
+			t.Fatalf("listen(%s) = %s, want %s", name, got, want)
+		}
+		ls = append(ls, l)
+	}
+	if ok, err := HandoffReady(); !ok || err != nil {
+		t.Fatalf("HandoffReady = %v, %v", ok, err)
+	}
+
+	for _, l := range ls {
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line, err := bufio.NewReader(c).ReadString('\n'); line != "ping\n" {
+			t.Errorf("%s: got %q, %v", listenerAddr(l), line, err)
+		}
+		c.Write([]byte("pong\n"))
+		c.Close()
+	}
+	buf := make([]byte, 16)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping\n" {
+		t.Errorf("udp: got %q", buf[:n])
+	}
+	pc.WriteTo([]byte("pong\n"), addr)
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// clientIP は "192.168.1.12:51234" のような RemoteAddr からポート番号を除いた IP アドレスを返す。
+// Unix ソケットのクライアントはアドレスを持たないため "unknown" を返す。
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		if net.ParseIP(remoteAddr) == nil {
+			return "unknown"
+		}
+		return remoteAddr
+	}
+	return host
+}
+
+// setForwardHeaders は in を受け取った際の情報を元に、上流へ送る out のヘッダを fh の設定に従って書き換える。
+// out は in の複製か in 自身で、ホップ間のヘッダはまだ残っていても構わない。
+func setForwardHeaders(out *http.Request, in *http.Request, fh *config.ForwardHeaders) {
+	// このプロキシ宛てのヘッダは上流へ渡さない。上流の認証情報は Transport が付け直す。
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	// 上流を欺けないよう、クライアントが付けた値は渡さない
+	out.Header.Del("X-Forwarded-Host")
+	out.Header.Del("X-Forwarded-Proto")
+
+	ip := clientIP(in.RemoteAddr)
+	trusted := fh.IsTrusted(net.ParseIP(ip))
+
+	// enabled は mode に従ってヘッダを付けるかを、inherit は受け取った値を引き継ぐかを返す。
+	enabled := func(mode config.HeaderMode) bool {
+		return mode == config.HeaderOn || mode == config.HeaderTrusted && trusted
+	}
+	inherit := func(mode config.HeaderMode) bool {
+		return enabled(mode) && trusted
+	}
+
+	xff := in.Header["X-Forwarded-For"]
+	out.Header.Del("X-Forwarded-For")
+	if enabled(fh.XForwardedFor) {
+		v := ip
+		if inherit(fh.XForwardedFor) && len(xff) > 0 {
+			v = strings.Join(xff, ", ") + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", v)
+	}
+
+	xrip := in.Header.Get("X-Real-IP")
+	out.Header.Del("X-Real-IP")
+	if enabled(fh.XRealIP) {
+		v := ip
+		if inherit(fh.XRealIP) && xrip != "" {
+			v = xrip
+		}
+		out.Header.Set("X-Real-IP", v)
+	}
+
+	fwd := in.Header["Forwarded"]
+	out.Header.Del("Forwarded")
+	if enabled(fh.Forwarded) {
+		v := forwardedElement(ip, in)
+		if inherit(fh.Forwarded) && len(fwd) > 0 {
+			v = strings.Join(fwd, ", ") + ", " + v
+		}
+		out.Header.Set("Forwarded", v)
+	}
+
+	addVia(out.Header, in.ProtoMajor, in.ProtoMinor, fh.Via)
+}
+
+// forwardedElement は RFC 7239 の Forwarded ヘッダの要素をひとつ作成する。
+func forwardedElement(ip string, r *http.Request) string {
+	node := ip
+	if strings.Contains(ip, ":") {
+		// IPv6 のアドレスは角括弧で囲み、引用符で括る
+		node = `"[` + ip + `]"`
+	}
+	v := "for=" + node
+	if r.Host != "" {
+		v += ";host=" + quoteForwarded(r.Host)
+	}
+	proto := "http"
+	if r.URL.Scheme != "" {
+		proto = r.URL.Scheme
+	}
+	return v + ";proto=" + proto
+}
+
+// quoteForwarded は token として書けない値を引用符で括る。
+func quoteForwarded(s string) string {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+	}
+	return s
+}
+
+// addVia は RFC 7230 に従い、受け取ったメッセージのプロトコルのバージョンと name を Via ヘッダに追加する。
+// name が空の場合は何もしない。
+func addVia(h http.Header, major, minor int, name string) {
+	if name == "" {
+		return
+	}
+	v := strconv.Itoa(major) + "." + strconv.Itoa(minor)
+	if major >= 2 {
+		v = strconv.Itoa(major)
+	}
+	v += " " + name
+	if prior := h["Via"]; len(prior) > 0 {
+		v = strings.Join(prior, ", ") + ", " + v
+	}
+	h.Set("Via", v)
+}
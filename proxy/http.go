@@ -1,14 +1,13 @@
 package proxy
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"runtime"
-	"strconv"
 	"time"
 
 	"github.com/mimoto-xxxxxx/proxy-relay/config"
@@ -16,65 +15,115 @@ import (
 
 // HTTP はひとつのポートを Listen して HTTP プロキシとして振る舞う。
 type HTTP struct {
-	Logger   *log.Logger
-	Handler  http.Handler // 任意の Web アクセス用
-	listener net.Listener
-	server   *http.Server
-	sig      chan struct{}
-	proxy    *config.Proxy
+	Logger       *log.Logger
+	Handler      http.Handler          // 任意の Web アクセス用
+	DrainTimeout time.Duration         // Close の際に処理中の接続の完了を待つ最大時間
+	Timeouts     config.Timeouts       // CONNECT で中継する接続の時間制限
+	Upstream     *Upstream             // 上流の HTTP プロキシへの接続プール。nil の場合はポートごとに作成する
+	Headers      config.ForwardHeaders // 上流へ送るリクエストにクライアントの情報を付けるかどうかの設定
+	HeaderRules  []config.HeaderRule   // 接続先ごとにヘッダを書き換える規則
+	MITM         *MITM                 // CONNECT の TLS を終端するホストの設定。nil の場合は終端しない
+	Blocker      *Blocker              // 接続を拒否する接続先の一覧。nil の場合は拒否しない
+	Cache        *Cache                // 上流から取得したレスポンスのキャッシュ。nil の場合はキャッシュしない
+	Resolver     *Resolver             // 接続先のホスト名を上流へ渡す前に名前解決する設定。nil の場合は名前のまま渡す
+	Socket       config.SocketOptions  // Unix ソケットで待ち受ける場合のファイルの権限
+	listener     net.Listener
+	server       *http.Server
+	forward      http.Handler // 上流の HTTP プロキシへリクエストを送るハンドラ
+	conns        *tracker
+	proxy        *config.Proxy
 }
 
 // New は新しい HTTP プロキシサーバを作成する。
 // 実際に使用するプロキシ設定は proxy で指定する。
 func NewHTTP(proxy *config.Proxy) *HTTP {
 	return &HTTP{
-		Logger: log.New(os.Stderr, "", log.LstdFlags),
-		proxy:  proxy,
+		Logger:       log.New(os.Stderr, "", log.LstdFlags),
+		DrainTimeout: 1 * time.Second,
+		conns:        newTracker(),
+		proxy:        proxy,
 	}
 }
 
-// Close は Listen していたポートを開放して処理を返し、goroutine 経由でクライアント接続も閉じていく。
+// Close は Listen していたポートを開放し、処理中の接続が完了するのを DrainTimeout まで待つ。
 func (srv *HTTP) Close() error {
+	return srv.Shutdown(srv.DrainTimeout)
+}
+
+// Shutdown は Listen していたポートを開放して新しい接続の受付を止め、
+// 処理中のリクエストや CONNECT のトンネルが完了するのを最大 timeout まで待つ。
+// timeout を過ぎても残っている接続は強制的に閉じる。
+func (srv *HTTP) Shutdown(timeout time.Duration) error {
 	err := srv.listener.Close()
-	// 維持しているコネクションも閉じる
-	srv.sig <- struct{}{}
-	<-srv.sig
+	// 待機中の Keep-Alive 接続はここで閉じられる
+	srv.server.SetKeepAlivesEnabled(false)
+	if n := srv.conns.drain(timeout); n > 0 {
+		srv.Logger.Printf("%s: closed %d connections after %v", srv.listener.Addr(), n, timeout)
+	}
 	return err
 }
 
-// ListenAndServe は addr で Listen して通信の待受状態に入る。
+// ListenAndServe は addr で Listen して通信の待受状態に入る。addr を "unix:/path" とすると Unix ソケットで待ち受ける。
 // Listen が成功したかどうかを errch を通じて返し、Serve の結果は Logger を経由して出力する。
 func (srv *HTTP) ListenAndServe(addr string, errch chan<- error) {
-	l, err := net.Listen("tcp", addr)
+	l, err := listen(addr, srv.Socket)
+	if err == nil {
+		srv.init(l)
+	}
 	errch <- err
 	if err != nil {
 		return
 	}
 
-	if err = srv.serveHTTP(l); err != nil {
+	if err = srv.server.Serve(l); err != nil {
 		if oe, ok := err.(*net.OpError); !ok || oe.Err.Error() != "use of closed network connection" {
 			srv.Logger.Println("ListenAndServe:", err)
 		}
 	}
 }
 
-// ServeHTTP は HTTP プロキシとして l を処理する。
-func (srv *HTTP) serveHTTP(l net.Listener) error {
-	defer l.Close()
+// init は l を HTTP プロキシとして処理するための準備を行う。
+func (srv *HTTP) init(l net.Listener) {
 	srv.listener = l
-	srv.sig = make(chan struct{})
 
-	tp := &http.Transport{Proxy: http.ProxyURL(&url.URL{
-		Host: srv.proxy.Host + ":" + strconv.Itoa(srv.proxy.HTTPPort),
-		User: url.UserPassword(srv.proxy.Username, srv.proxy.Password),
-	})}
+	if srv.Upstream == nil {
+		srv.Upstream = NewUpstream(srv.proxy, config.Transport{}, srv.Timeouts.Dial)
+	}
+	var transport http.RoundTripper = srv.Upstream
+	if srv.Resolver != nil {
+		transport = srv.Resolver.Transport(transport)
+	}
+	if srv.Cache != nil {
+		transport = srv.Cache.Transport(transport)
+	}
+	// Rewrite を使うと ReverseProxy が解釈できないクエリを削除してしまうため、URL をそのまま送れる Director を使う
 	rp := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
-			r.Header.Add("X-Real-IP", r.RemoteAddr)
+			r.RemoteAddr, _ = r.Context().Value(remoteAddrKey{}).(string)
+			setForwardHeaders(r, r, &srv.Headers)
+			applyHeaderRules(r, srv.HeaderRules)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, srv.Headers.Via)
+			applyResponseHeaderRules(resp, srv.HeaderRules)
+			return nil
 		},
-		Transport: tp,
+		Transport: transport,
 	}
+	// ReverseProxy は Director の後で X-Forwarded-For にクライアントの IP アドレスを付け足すため、
+	// RemoteAddr を空にしたリクエストを渡し、元の値はコンテキストで Director に渡す
+	srv.forward = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := r.WithContext(context.WithValue(r.Context(), remoteAddrKey{}, r.RemoteAddr))
+		out.RemoteAddr = ""
+		rp.ServeHTTP(w, out)
+	})
 	srv.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.IsAbs() || r.Method == "CONNECT" {
+			if srv.Blocker.block(w, r, srv.Logger) {
+				return
+			}
+		}
+
 		if r.Method == "CONNECT" {
 			srv.serveHTTPConnect(w, r)
 			return
@@ -87,83 +136,29 @@ func (srv *HTTP) serveHTTP(l net.Listener) error {
 			return
 		}
 
-		rp.ServeHTTP(w, r)
+		if isUpgrade(r) {
+			srv.serveUpgrade(w, r)
+			return
+		}
+
+		srv.forward.ServeHTTP(w, r)
 	})}
-	return run(srv.server, l, 1*time.Second, srv.sig)
-}
 
-// Based on github.com/stretchr/graceful Copyright (c) 2014 Stretchr, Inc.
-func run(server *http.Server, listener net.Listener, timeout time.Duration, c chan struct{}) error {
-	// Track connection state
-	add := make(chan net.Conn)
-	remove := make(chan net.Conn)
-	server.ConnState = func(conn net.Conn, state http.ConnState) {
+	// 処理中の接続を記録する。
+	// Hijack された接続は以後通知されないため、serveHTTPConnect が終了時に取り除く。
+	srv.server.ConnState = func(c net.Conn, state http.ConnState) {
 		switch state {
 		case http.StateActive:
-			add <- conn
+			srv.conns.add(c)
 		case http.StateClosed, http.StateIdle:
-			remove <- conn
-		}
-	}
-
-	// Manage open connections
-	stop := make(chan chan struct{})
-	kill := make(chan struct{})
-	go func() {
-		var done chan struct{}
-		connections := map[net.Conn]struct{}{}
-		for {
-			select {
-			case conn := <-add:
-				connections[conn] = struct{}{}
-			case conn := <-remove:
-				delete(connections, conn)
-				if done != nil && len(connections) == 0 {
-					done <- struct{}{}
-					return
-				}
-			case done = <-stop:
-				if len(connections) == 0 {
-					done <- struct{}{}
-					return
-				}
-			case <-kill:
-				for k := range connections {
-					k.Close()
-				}
-				return
-			}
-		}
-	}()
-
-	ended := make(chan struct{})
-	go func() {
-		<-c
-		server.SetKeepAlivesEnabled(false)
-		listener.Close()
-		ended <- struct{}{}
-	}()
-
-	// Serve with graceful listener
-	err := server.Serve(listener)
-
-	// Request done notification
-	done := make(chan struct{})
-	stop <- done
-
-	if timeout > 0 {
-		select {
-		case <-done:
-		case <-time.After(timeout):
-			kill <- struct{}{}
+			srv.conns.remove(c)
 		}
-	} else {
-		<-done
 	}
-	c <- <-ended
-	return err
 }
 
+// remoteAddrKey は上流へ転送するリクエストのクライアントのアドレスを Director に渡すためのコンテキストのキー。
+type remoteAddrKey struct{}
+
 // HTTP の Connect メソッドの実装。Connect のリクエストだがコードを使いまわすため先は SOCKS プロキシで繋ぐ。
 func (srv *HTTP) serveHTTPConnect(w http.ResponseWriter, r *http.Request) {
 	hij, ok := w.(http.Hijacker)
@@ -185,9 +180,21 @@ func (srv *HTTP) serveHTTPConnect(w http.ResponseWriter, r *http.Request) {
 			srv.Logger.Printf("panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
 		}
 		c.Close()
+		srv.conns.remove(c)
 	}()
 
-	connected, err := connectSOCKS(c, r.URL.Host, srv.proxy, []byte("HTTP/1.0 200 OK\r\n\r\n"))
+	if srv.MITM.match(hostname(r.URL)) {
+		if err := srv.serveMITM(c, r.URL.Host); err != nil {
+			srv.Logger.Println("serveMITM:", err)
+		}
+		return
+	}
+
+	connected := false
+	addr, err := srv.Resolver.Resolve(r.URL.Host)
+	if err == nil {
+		connected, err = connectSOCKS(c, addr, srv.proxy, []byte("HTTP/1.0 200 OK\r\n\r\n"), srv.Timeouts, nil)
+	}
 	if err != nil {
 		if !connected {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// TestForwardKeepsURL は上流へ転送するリクエストの URL が、ReverseProxy が解釈できない ";" や "%" を含むクエリでも
+// そのまま送られること、クライアントの情報を伝えるヘッダが設定に従って付け直されることを確かめる。
+func TestForwardKeepsURL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Host", "Proxy-Authorization", "Via"} {
+			io.WriteString(w, k+": "+strings.Join(r.Header[k], ", ")+"\n")
+		}
+	}))
+	defer backend.Close()
+	upstream := newFakeUpstream(t)
+	defer upstream.l.Close()
+
+	srv := NewHTTP(&config.Proxy{Host: "127.0.0.1", HTTPPort: upstream.port()})
+	srv.Timeouts = config.Timeouts{Dial: 5 * time.Second}
+	srv.Headers = config.ForwardHeaders{XForwardedFor: config.HeaderOn, Via: "proxy-relay"}
+	errch := make(chan error, 1)
+	go srv.ListenAndServe("127.0.0.1:0", errch)
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	uri := "http://" + backend.Listener.Addr().String() + "/echo?a=1;b=2&c=%zz"
+	req := "GET " + uri + " HTTP/1.1\r\nHost: " + backend.Listener.Addr().String() + "\r\n" +
+		"X-Forwarded-For: 192.0.2.1\r\nX-Forwarded-Host: spoofed.example\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, b)
+	}
+
+	upstream.mu.Lock()
+	uris := upstream.uris
+	upstream.mu.Unlock()
+	if len(uris) != 1 || uris[0] != uri {
+		t.Errorf("upstream received %q, want %q", uris, uri)
+	}
+	// 信頼できないクライアントの X-Forwarded-For は引き継がず、自分で付けた値だけを送る
+	want := "X-Forwarded-For: 127.0.0.1\nX-Forwarded-Host: \nProxy-Authorization: \nVia: 1.1 proxy-relay\n"
+	if string(b) != want {
+		t.Errorf("backend received headers\n%s\nwant\n%s", b, want)
+	}
+}
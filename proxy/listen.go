@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// listen は addr で Listen する。addr が "unix:/path" の形式の場合は Unix ソケットで、それ以外は TCP で待ち受ける。
+// Unix ソケットの場合は前回の起動で残ったファイルを削除してから待ち受け、opt に従ってファイルの権限を設定する。
+// 他のプロセスが待ち受けているソケットのファイルは削除せずにエラーを返す。
+// systemd や Handoff で addr に対応するソケットを受け取っている場合は、新たに待ち受けずにそれを使う。
+// 返した net.Listener は Close するまで Handoff で引き継ぐ対象になる。
+func listen(addr string, opt config.SocketOptions) (net.Listener, error) {
+	l, err := inheritedListener(addr)
+	if l == nil && err == nil {
+		l, err = listenNew(addr, opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	track(addr, l)
+	return &trackedListener{Listener: l, name: addr}, nil
+}
+
+// listenPacket は addr の UDP で待ち受ける。Handoff で受け取ったソケットがあればそれを使う。
+// 返した net.PacketConn は Close するまで Handoff で引き継ぐ対象になる。
+func listenPacket(addr string) (net.PacketConn, error) {
+	c, err := inheritedPacketConn(addr)
+	if c == nil && err == nil {
+		c, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	track("udp:"+addr, c)
+	return &trackedPacketConn{PacketConn: c, name: "udp:" + addr}, nil
+}
+
+// listenNew は addr で新たに Listen する。
+func listenNew(addr string, opt config.SocketOptions) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// 誰も待ち受けていない前回の起動で残ったファイルだけを削除する
+		c, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen unix %s: another process is listening on the socket", path)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			os.Remove(path)
+		}
+	}
+	l, mode, err := listenUnixSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	if opt.UID != -1 || opt.GID != -1 {
+		if err := os.Lchown(path, opt.UID, opt.GID); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if opt.Mode != 0 {
+		mode = opt.Mode
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
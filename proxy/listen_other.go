@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package proxy
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnixSocket は path の Unix ソケットで待ち受ける。umask が無いため権限は変更しない。
+func listenUnixSocket(path string) (net.Listener, os.FileMode, error) {
+	l, err := net.Listen("unix", path)
+	return l, 0, err
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// TestListenUnix は Unix ソケットで待ち受ける際に、前回の起動で残ったファイルだけを置き換え、
+// 他のプロセスが待ち受けているソケットは残すこと、指定した権限が設定されることを確かめる。
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	opt := config.SocketOptions{Mode: 0600, UID: -1, GID: -1}
+
+	// 別のプロセスが待ち受けている状態
+	other, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenNew("unix:"+path, opt); err == nil {
+		l.Close()
+		t.Fatal("listened on a socket in use by another listener")
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("the other listener's socket was removed: %v", err)
+	}
+	c.Close()
+
+	// 前回の起動で残ったファイル
+	other.(*net.UnixListener).SetUnlinkOnClose(false)
+	other.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenNew("unix:"+path, opt)
+	if err != nil {
+		t.Fatalf("could not replace a stale socket: %v", err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+	c, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
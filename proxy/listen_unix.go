@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex // umask はプロセス全体の設定のため、変更している間は他の listenUnixSocket を待たせる
+
+// listenUnixSocket は path の Unix ソケットで待ち受ける。
+// 権限を設定する前に他のユーザーから繋がれないよう、所有者だけが読み書きできる権限でファイルを作成し、
+// 元の umask で作成した場合の権限を返す。
+func listenUnixSocket(path string) (net.Listener, os.FileMode, error) {
+	umaskMu.Lock()
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	umaskMu.Unlock()
+	return l, 0777 &^ os.FileMode(old), err
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// MITM は CONNECT で指定されたホストとの TLS を終端し、中の HTTP リクエストを検査するための設定。
+type MITM struct {
+	CA    *CA
+	Hosts []string // TLS を終端するホスト名のパターン。config.MatchHost の形式。
+}
+
+// match は host との通信の TLS を終端するかを返す。
+func (m *MITM) match(host string) bool {
+	if m == nil || m.CA == nil {
+		return false
+	}
+	for _, pattern := range m.Hosts {
+		if config.MatchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMITM は CONNECT で確立した c との TLS を終端し、復号したリクエストを通常の HTTP プロキシと同じ経路で上流へ送る。
+// 上流へは Upstream が改めて TLS で接続する。
+// 証明書は CONNECT で指定された host のものだけを発行し、Host ヘッダが host と異なるリクエストは 421 で拒否する。
+// CONNECT のトンネルと同じく srv.Timeouts の idle_timeout と max_duration を適用する。
+func (srv *HTTP) serveMITM(c net.Conn, host string) error {
+	if _, err := c.Write([]byte("HTTP/1.0 200 OK\r\n\r\n")); err != nil {
+		return err
+	}
+
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+	tc := tls.Server(c, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return srv.MITM.CA.Certificate(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	if t := srv.Timeouts.MaxDuration; t > 0 {
+		timer := time.AfterFunc(t, func() { tc.Close() })
+		defer timer.Stop()
+	}
+	if t := srv.Timeouts.Idle; t > 0 {
+		tc.SetDeadline(time.Now().Add(t))
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+
+	l := newConnListener(tc)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "" && !sameHost(r.Host, host) {
+				http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+				srv.Logger.Printf("serveMITM: request for %s in the tunnel to %s", r.Host, host)
+				return
+			}
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if r.URL.Host == "" {
+				r.URL.Host = host
+			}
+			if srv.Blocker.block(w, r, srv.Logger) {
+				return
+			}
+			srv.forward.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: srv.Timeouts.Idle,
+		IdleTimeout:       srv.Timeouts.Idle,
+		ErrorLog:          srv.Logger,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	s.Serve(l)
+	return nil
+}
+
+// sameHost は Host ヘッダの値 h が CONNECT で指定された target と同じホストとポートを指すかを返す。
+// ポート番号が無い場合は 443 とみなす。
+func sameHost(h, target string) bool {
+	return strings.EqualFold(withPort(h, "443"), withPort(target, "443"))
+}
+
+// withPort は host にポート番号が無ければ port を付ける。
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// connListener はひとつの接続だけを Accept する net.Listener。
+// http.Server でひとつの接続を処理するために使用し、その接続が閉じられたら Accept を終える。
+type connListener struct {
+	conn net.Conn
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newConnListener(c net.Conn) *connListener {
+	l := &connListener{
+		conn: c,
+		ch:   make(chan net.Conn, 1),
+		done: make(chan struct{}),
+	}
+	l.ch <- c
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
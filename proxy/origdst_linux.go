@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// transparentSupported は透過プロキシが動作する環境かどうか。
+const transparentSupported = true
+
+// soOriginalDst は netfilter が REDIRECT する前の接続先を取得するためのソケットオプション。
+// IPv4 の SO_ORIGINAL_DST と IPv6 の IP6T_SO_ORIGINAL_DST は同じ値。
+const soOriginalDst = 80
+
+// originalDst は REDIRECT された接続 c の本来の接続先を返す。
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	la, _ := tc.LocalAddr().(*net.TCPAddr)
+	var addr *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if la != nil && la.IP.To4() != nil {
+			// sockaddr_in を IPv6Mreq の大きさの領域として受け取る
+			var mreq *syscall.IPv6Mreq
+			if mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); serr == nil {
+				b := mreq.Multiaddr
+				addr = &net.TCPAddr{
+					IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+					Port: int(b[2])<<8 | int(b[3]),
+				}
+			}
+			return
+		}
+		// sockaddr_in6 を IPv6MTUInfo の先頭として受け取る
+		var info *syscall.IPv6MTUInfo
+		if info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); serr == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr == syscall.ENOENT {
+		return nil, errors.New("no original destination (not a redirected connection)")
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+// TestOriginalDstDirect は REDIRECT されずに直接繋いできた接続では本来の接続先が得られないことを確かめる。
+func TestOriginalDstDirect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if dst, err := originalDst(c); err == nil && dst.String() != l.Addr().String() {
+		t.Errorf("originalDst = %v, want an error or the listener's address", dst)
+	}
+}
+
+// TestOriginalDst は新しいネットワーク名前空間で iptables の REDIRECT を設定し、転送されてきた接続の本来の接続先が得られることを確かめる。
+// root 権限と unshare, ip, iptables のコマンドが必要で、無い場合はスキップする。
+func TestOriginalDst(t *testing.T) {
+	if os.Getenv("PROXY_RELAY_NETNS") == "" {
+		if os.Getuid() != 0 {
+			t.Skip("requires root")
+		}
+		for _, name := range []string{"unshare", "ip", "iptables"} {
+			if _, err := exec.LookPath(name); err != nil {
+				t.Skipf("%s not found", name)
+			}
+		}
+		// ホストの設定を変えないよう、新しいネットワーク名前空間で自分自身を実行し直す
+		cmd := exec.Command("unshare", "-n", os.Args[0], "-test.run=^TestOriginalDst$", "-test.v")
+		cmd.Env = append(os.Environ(), "PROXY_RELAY_NETNS=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		t.Logf("%s", out)
+		return
+	}
+
+	run := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %v\n%s", args, err, out)
+		}
+	}
+	run("ip", "link", "set", "lo", "up")
+
+	tests := []struct {
+		iptables string
+		network  string
+		listen   string
+		dst      string
+	}{
+		{"iptables", "tcp4", "127.0.0.1:0", "127.0.0.2:443"},
+		{"ip6tables", "tcp6", "[::1]:0", "[::1]:443"},
+	}
+	for _, tt := range tests {
+		if _, err := exec.LookPath(tt.iptables); err != nil {
+			t.Logf("%s not found, skipping %s", tt.iptables, tt.network)
+			continue
+		}
+		l, err := net.Listen(tt.network, tt.listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		host, port, _ := net.SplitHostPort(tt.dst)
+		run(tt.iptables, "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", host, "--dport", port,
+			"-j", "REDIRECT", "--to-ports", strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+
+		client, err := net.Dial(tt.network, tt.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		dst, err := originalDst(c)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.network, err)
+		}
+		if dst.String() != tt.dst {
+			t.Errorf("%s: originalDst = %v, want %s", tt.network, dst, tt.dst)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// transparentSupported は透過プロキシが動作する環境かどうか。
+const transparentSupported = false
+
+// originalDst は Linux 以外では使用できない。
+func originalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("SO_ORIGINAL_DST is not supported")
+}
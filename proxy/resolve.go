@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// resolveTimeout は手元で名前解決する際の時間制限。
+const resolveTimeout = 5 * time.Second
+
+// Resolver は接続先のホスト名を上流へ渡す前に、設定に従って IP アドレスに置き換える。
+// nil の場合は全てホスト名のまま上流へ渡す。
+type Resolver struct {
+	hosts map[string]net.IP
+	rules []config.ResolveRule
+	mode  config.ResolveMode
+}
+
+// NewResolver は新しい Resolver を作成する。hosts は名前解決せずに使う IP アドレス、
+// rules は接続先ごとの名前解決の方法で、どれにも一致しない場合は mode を使う。
+func NewResolver(hosts map[string]net.IP, rules []config.ResolveRule, mode config.ResolveMode) *Resolver {
+	return &Resolver{hosts: hosts, rules: rules, mode: mode}
+}
+
+// Mode は host の名前解決の方法を返す。
+func (r *Resolver) Mode(host string) config.ResolveMode {
+	if r == nil {
+		return config.ResolveRemote
+	}
+	for _, rr := range r.rules {
+		if config.MatchHost(rr.Host, host) {
+			return rr.Resolve
+		}
+	}
+	return r.mode
+}
+
+// static は host が [hosts] に記述されていればその IP アドレスを返す。
+func (r *Resolver) static(host string) net.IP {
+	if r == nil {
+		return nil
+	}
+	return r.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+}
+
+// Resolve は "example.com:443" のような addr を上流へ渡す形に変換する。
+// [hosts] に記述されたホスト名は常にその IP アドレスに置き換え、それ以外は Mode に従って手元で名前解決する。
+func (r *Resolver) Resolve(addr string) (string, error) {
+	if r == nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	if ip := r.static(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+
+	mode := r.Mode(host)
+	if mode == config.ResolveRemote {
+		return addr, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("lookup %s: no addresses", host)
+	}
+	if err != nil {
+		if mode == config.ResolveLocalThenRemote {
+			return addr, nil
+		}
+		return "", err
+	}
+	// 上流が IPv6 に繋がらないこともあるため IPv4 を優先する
+	ip := ips[0].IP
+	for _, a := range ips {
+		if a.IP.To4() != nil {
+			ip = a.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// Transport はリクエストの接続先を Resolve で置き換えてから next に渡す http.RoundTripper を返す。
+// 平文の HTTP は URL の接続先を置き換え、Host ヘッダは元のホスト名のまま送る。
+// HTTPS は証明書の検証に名前が必要なため URL はそのままにして、置き換えた接続先をコンテキストで Upstream に渡す。
+func (r *Resolver) Transport(next http.RoundTripper) http.RoundTripper {
+	return &resolveTransport{resolver: r, next: next}
+}
+
+type resolveTransport struct {
+	resolver *Resolver
+	next     http.RoundTripper
+}
+
+func (t *resolveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var port string
+	switch req.URL.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	default:
+		return t.next.RoundTrip(req)
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	resolved, err := t.resolver.Resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	if resolved == addr {
+		return t.next.RoundTrip(req)
+	}
+	if req.URL.Scheme == "https" {
+		return t.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), connectAddrKey{}, resolved)))
+	}
+	out := req.Clone(req.Context())
+	setRequestAddr(out, resolved)
+	return t.next.RoundTrip(out)
+}
+
+// connectAddrKey は HTTPS のリクエストで上流の HTTP プロキシに CONNECT で要求する接続先をコンテキストに入れるためのキー。
+type connectAddrKey struct{}
+
+// connectAddr は ctx に入っている CONNECT で要求する接続先を返す。入っていない場合は空文字列を返す。
+func connectAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(connectAddrKey{}).(string)
+	return addr
+}
+
+// setRequestAddr は r の接続先を addr に置き換え、Host ヘッダは元のホスト名のまま残す。
+// プロキシへ送るリクエストの URI は Request.Write が Host から作るため、Opaque で明示する。
+func setRequestAddr(r *http.Request, addr string) {
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+	r.URL.Host = addr
+	r.URL.Opaque = "//" + addr + r.URL.EscapedPath()
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// TestResolveTransportHTTPS は [hosts] で IP アドレスを指定した名前への HTTPS のリクエストが、
+// 上流の HTTP プロキシにその IP アドレスへの CONNECT として送られ、証明書はホスト名で検証されることを確かめる。
+func TestResolveTransportHTTPS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+	port := strconv.Itoa(backend.Listener.Addr().(*net.TCPAddr).Port)
+
+	upstream := newFakeUpstream(t)
+	defer upstream.l.Close()
+
+	u := NewUpstream(&config.Proxy{Host: "127.0.0.1", HTTPPort: upstream.port()}, config.Transport{}, 5*time.Second)
+	defer u.CloseIdleConnections()
+	// httptest の証明書は example.com の名前で発行されている
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	u.transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	rt := NewResolver(map[string]net.IP{"example.com": net.ParseIP("127.0.0.1")}, nil, config.ResolveRemote).Transport(u)
+	req, err := http.NewRequest("GET", "https://example.com:"+port+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s", resp.Status)
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if want := []string{"127.0.0.1:" + port}; len(upstream.uris) != 1 || upstream.uris[0] != want[0] {
+		t.Errorf("upstream received %q, want %q", upstream.uris, want)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// hostname は u の接続先からポート番号を除いたホスト名を返す。
+func hostname(u *url.URL) string {
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		return host
+	}
+	return u.Host
+}
+
+// applyHeaderRules は r に一致する規則のリクエストヘッダへの操作を r に適用する。
+func applyHeaderRules(r *http.Request, rules []config.HeaderRule) {
+	host := hostname(r.URL)
+	for i := range rules {
+		if rules[i].Match(host, r.Method, r.URL.Path) {
+			applyHeaderActions(r.Header, &rules[i].Request)
+		}
+	}
+}
+
+// applyResponseHeaderRules は resp のリクエストに一致する規則のレスポンスヘッダへの操作を resp に適用する。
+func applyResponseHeaderRules(resp *http.Response, rules []config.HeaderRule) {
+	r := resp.Request
+	if r == nil {
+		return
+	}
+	host := hostname(r.URL)
+	for i := range rules {
+		if rules[i].Match(host, r.Method, r.URL.Path) {
+			applyHeaderActions(resp.Header, &rules[i].Response)
+		}
+	}
+}
+
+// applyHeaderActions は a の操作を Remove, Set, Add の順に h に適用する。
+func applyHeaderActions(h http.Header, a *config.HeaderActions) {
+	for _, k := range a.Remove {
+		h.Del(k)
+	}
+	for k, v := range a.Set {
+		h.Set(k, v)
+	}
+	for k, v := range a.Add {
+		h.Add(k, v)
+	}
+}
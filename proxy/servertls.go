@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// NewServerTLS は opt に従ってリバースプロキシで TLS を終端するための設定を作成する。
+// 証明書のファイルが指定されていない場合は selfSigned を使う。
+func NewServerTLS(opt *config.ServerTLS, selfSigned *tls.Certificate) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opt.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	} else {
+		tc.Certificates = []tls.Certificate{*selfSigned}
+	}
+
+	if opt.ClientCA != "" {
+		pool, err := loadCertPool(opt.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// NewClientTLS は opt に従ってリバースプロキシで接続先との間の TLS を開始するための設定を作成する。
+func NewClientTLS(opt *config.ClientTLS) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opt.ServerName,
+	}
+	if opt.CAFile != "" {
+		// 指定された認証局が発行した証明書だけを信頼する
+		pool, err := loadCertPool(opt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if opt.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// loadCertPool は PEM 形式の証明書のファイルを読み込む。
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
@@ -1,10 +1,14 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/tls"
+	"io"
 	"log"
 	"net"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/mimoto-xxxxxx/proxy-relay/config"
@@ -12,13 +16,26 @@ import (
 
 // SOCKS は SOCKS v5 プロトコルを利用したリバースプロキシサーバ。
 type SOCKS struct {
-	Logger    *log.Logger
-	listener  net.Listener
-	connectTo string
-	proxy     *config.Proxy
-	closed    chan struct{}
+	Logger       *log.Logger
+	DrainTimeout time.Duration        // Close の際に処理中の接続の完了を待つ最大時間
+	Timeouts     config.Timeouts      // 中継する接続の時間制限
+	Resolver     *Resolver            // 接続先のホスト名を上流へ渡す前に名前解決する設定。nil の場合は名前のまま渡す
+	SNI          *config.SNIRoute     // TLS の SNI で接続先を選ぶ設定。nil の場合は常に connectTo へ繋ぐ
+	TLS          *tls.Config          // クライアントとの TLS を終端する設定。nil の場合は終端しない
+	BackendTLS   *tls.Config          // 接続先との間で TLS を開始する設定。nil の場合はそのまま中継する
+	Allow        []*net.IPNet         // 接続を許可するクライアントのアドレス。空の場合は全て許可する
+	MaxConns     int                  // 同時に中継する接続の最大数。0 の場合は制限しない
+	Socket       config.SocketOptions // Unix ソケットで待ち受ける場合のファイルの権限
+	listener     net.Listener
+	connectTo    string
+	proxy        *config.Proxy
+	conns        *tracker
+	closed       chan struct{}
 }
 
+// clientHelloTimeout は接続先を選ぶための最初のデータや、TLS のハンドシェイクを待つ最大時間。
+const clientHelloTimeout = 10 * time.Second
+
 // conn は SOCKS が Accept した通信の続きを担い、リバースプロキシとして振る舞うために使用される。
 type conn struct {
 	server *SOCKS
@@ -27,20 +44,26 @@ type conn struct {
 }
 
 // New は新しい SOCKS を作成する。connectTo には "example.com:80" のような情報を渡す。
+// connectTo を "unix:/path" とすると上流を経由せずに手元の Unix ソケットに繋ぐ。
 // 実際に使用するプロキシ設定は proxy で指定する。
 func NewSOCKS(connectTo string, proxy *config.Proxy) *SOCKS {
 	return &SOCKS{
-		Logger:    log.New(os.Stderr, "", log.LstdFlags),
-		connectTo: connectTo,
-		proxy:     proxy,
-		closed:    make(chan struct{}),
+		Logger:       log.New(os.Stderr, "", log.LstdFlags),
+		DrainTimeout: 1 * time.Second,
+		connectTo:    connectTo,
+		proxy:        proxy,
+		conns:        newTracker(),
+		closed:       make(chan struct{}),
 	}
 }
 
-// ListenAndServe は addr で Listen して通信の待受状態に入る。
+// ListenAndServe は addr で Listen して通信の待受状態に入る。addr を "unix:/path" とすると Unix ソケットで待ち受ける。
 // Listen が成功したかどうかを errch を通じて返し、Serve の結果は Logger を経由して出力する。
 func (srv *SOCKS) ListenAndServe(addr string, errch chan<- error) {
-	l, err := net.Listen("tcp", addr)
+	l, err := listen(addr, srv.Socket)
+	if err == nil {
+		srv.listener = l
+	}
 	errch <- err
 	if err != nil {
 		return
@@ -56,7 +79,6 @@ func (srv *SOCKS) ListenAndServe(addr string, errch chan<- error) {
 // ServeSOCKS はリバースプロキシとして l を処理する。
 func (srv *SOCKS) serveSOCKS(l net.Listener) error {
 	defer l.Close()
-	srv.listener = l
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		rw, err := l.Accept()
@@ -83,6 +105,10 @@ func (srv *SOCKS) serveSOCKS(l net.Listener) error {
 			return err
 		}
 		tempDelay = 0
+		if !srv.allowed(rw) {
+			rw.Close()
+			continue
+		}
 		c, err := srv.newConn(rw)
 		if err != nil {
 			srv.Logger.Printf("relay: SOCKS.newConn: %v", err)
@@ -92,19 +118,55 @@ func (srv *SOCKS) serveSOCKS(l net.Listener) error {
 	}
 }
 
-// Close は Listen を終了する。
+// Close は Listen を終了し、処理中の接続が完了するのを DrainTimeout まで待つ。
 func (srv *SOCKS) Close() error {
+	return srv.Shutdown(srv.DrainTimeout)
+}
+
+// Shutdown は Listen を終了して新しい接続の受付を止め、処理中の接続が完了するのを最大 timeout まで待つ。
+// timeout を過ぎても残っている接続は強制的に閉じ、その数を Logger に出力する。
+func (srv *SOCKS) Shutdown(timeout time.Duration) error {
 	err := srv.listener.Close()
 	<-srv.closed
+	if n := srv.conns.drain(timeout); n > 0 {
+		srv.Logger.Printf("%s->%s: closed %d connections after %v", srv.listener.Addr(), srv.connectTo, n, timeout)
+	}
 	return err
 }
 
+// allowed は Allow と MaxConns に照らして c を受け付けるかどうかを返す。受け付けない場合は理由を Logger に出力する。
+func (srv *SOCKS) allowed(c net.Conn) bool {
+	if len(srv.Allow) > 0 {
+		var ip net.IP
+		if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			ip = ta.IP
+		}
+		ok := false
+		for _, n := range srv.Allow {
+			if ip != nil && n.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			srv.Logger.Printf("%s->%s: %s is not allowed", srv.listener.Addr(), srv.connectTo, c.RemoteAddr())
+			return false
+		}
+	}
+	if srv.MaxConns > 0 && srv.conns.count() >= srv.MaxConns {
+		srv.Logger.Printf("%s->%s: too many connections (max_conns %d), closing %s", srv.listener.Addr(), srv.connectTo, srv.MaxConns, c.RemoteAddr())
+		return false
+	}
+	return true
+}
+
 // newConn はサーバが Accept したクライアントに対応するインスタンスを用意する。
 func (srv *SOCKS) newConn(c net.Conn) (*conn, error) {
 	conn := &conn{
 		server: srv,
 		rwc:    c,
 	}
+	srv.conns.add(c)
 	return conn, nil
 }
 
@@ -120,7 +182,40 @@ func (c *conn) serve() {
 		c.close()
 	}()
 
-	if _, err := connectSOCKS(c.rwc, c.server.connectTo, c.server.proxy, nil); err != nil {
+	rwc, connectTo := c.rwc, c.server.connectTo
+	if c.server.TLS != nil {
+		// 復号したデータをそのまま接続先へ送る
+		tc := tls.Server(rwc, c.server.TLS)
+		tc.SetDeadline(time.Now().Add(clientHelloTimeout))
+		if err := tc.Handshake(); err != nil {
+			c.server.Logger.Printf("%s: TLS handshake with %s: %v", c.server.listener.Addr(), rwc.RemoteAddr(), err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		rwc = tc
+	}
+	if c.server.SNI != nil {
+		host, peeked := sniffHost(rwc, clientHelloTimeout)
+		if connectTo = c.server.SNI.Target(host); connectTo == "" {
+			c.server.Logger.Printf("%s: no route for SNI %q", c.server.listener.Addr(), host)
+			return
+		}
+		// TLS は終端しないため、読み出した ClientHello はそのまま接続先へ送る
+		rwc = &prefixConn{Conn: rwc, r: io.MultiReader(bytes.NewReader(peeked), rwc)}
+	}
+
+	if strings.HasPrefix(connectTo, "unix:") {
+		if err := connectUnix(rwc, strings.TrimPrefix(connectTo, "unix:"), c.server.Timeouts); err != nil {
+			c.server.Logger.Println(err)
+		}
+		return
+	}
+	addr, err := c.server.Resolver.Resolve(connectTo)
+	if err != nil {
+		c.server.Logger.Println(err)
+		return
+	}
+	if _, err := connectSOCKS(rwc, addr, c.server.proxy, nil, c.server.Timeouts, c.server.BackendTLS); err != nil {
 		c.server.Logger.Println(err)
 		return
 	}
@@ -130,6 +225,7 @@ func (c *conn) serve() {
 func (c *conn) close() {
 	if c.rwc != nil {
 		c.rwc.Close()
+		c.server.conns.remove(c.rwc)
 		c.rwc = nil
 	}
 }
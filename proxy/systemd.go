@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenFdsStart は systemd のソケットアクティベーションで渡される最初のファイルディスクリプタの番号。
+const listenFdsStart = 3
+
+var (
+	inheritedMu sync.Mutex
+	inherited   = make(map[string]*os.File) // systemd から受け取ったソケット。activationName の名前ごと
+	claimed     = make(map[string]bool)     // 待ち受けに使った inherited の名前
+)
+
+// InheritListeners は systemd のソケットアクティベーションで LISTEN_FDS として渡されたソケットを受け取り、その数を返す。
+// 受け取ったソケットは FileDescriptorName の名前で記録し、同じ名前のアドレスで待ち受ける際に Listen の代わりに使う。
+// 名前は TCP ならポート番号 ("40000")、Unix ソケットならファイルのパス ("/run/proxy-relay/http.sock") で、
+// FileDescriptorName が指定されていない場合はソケットのアドレスから同じように決める。
+// 受け取ったソケットは閉じずに保持し続けるため、設定を再読み込みしても待ち受けが途切れない。
+// 最初の設定で使わなかったソケットは CloseUnclaimed で閉じる。
+// Handoff で起動された場合は、元のプロセスが待ち受けていたソケットを同じように受け取る。
+func InheritListeners() (int, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(handoffEnv)
+		os.Unsetenv(handoffNamesEnv)
+	}()
+	var names []string
+	if fd, err := strconv.Atoi(os.Getenv(handoffEnv)); err == nil {
+		handoffW = os.NewFile(uintptr(fd), "handoff")
+		names = strings.Split(os.Getenv(handoffNamesEnv), "\n")
+	} else if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+		names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	} else {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return 0, nil
+	}
+
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		if handoffW != nil {
+			// Handoff では待ち受けていたアドレスがそのまま名前になっている
+			inherited[name] = f
+			continue
+		}
+		l, err := net.FileListener(f)
+		if err != nil {
+			return i, fmt.Errorf("LISTEN_FDS: fd %d (%s): %v", listenFdsStart+i, name, err)
+		}
+		// 名前が無い場合に systemd が付ける "unknown" などはアドレスから決めた名前に置き換える
+		if name == "" || name == "unknown" || name == "stored" || name == "connection" {
+			name = activationName(listenerAddr(l))
+		}
+		l.Close()
+		inherited[name] = f
+	}
+	return n, nil
+}
+
+// inheritedListener は addr で待ち受けるためのソケットを systemd や Handoff で受け取っていれば、それを使う net.Listener を返す。
+// 受け取っていない場合は nil を返す。
+func inheritedListener(addr string) (net.Listener, error) {
+	inheritedMu.Lock()
+	name := addr
+	if inherited[name] == nil {
+		name = activationName(addr)
+	}
+	f := inherited[name]
+	if f != nil {
+		claimed[name] = true
+	}
+	inheritedMu.Unlock()
+	if f == nil {
+		return nil, nil
+	}
+	// 複製したファイルディスクリプタを使うため、返した net.Listener を閉じても元のソケットは待ち受けを続ける
+	return net.FileListener(f)
+}
+
+// inheritedPacketConn は addr の UDP で待ち受けるためのソケットを Handoff で受け取っていれば、それを使う net.PacketConn を返す。
+// 受け取っていない場合は nil を返す。
+func inheritedPacketConn(addr string) (net.PacketConn, error) {
+	inheritedMu.Lock()
+	f := inherited["udp:"+addr]
+	if f != nil {
+		claimed["udp:"+addr] = true
+	}
+	inheritedMu.Unlock()
+	if f == nil {
+		return nil, nil
+	}
+	return net.FilePacketConn(f)
+}
+
+// CloseUnclaimed は受け取ったソケットのうち、まだ待ち受けに使われていないものを閉じてその数を返す。
+// 最初に設定を読み込んだ後に呼ぶと、設定から取り除かれたアドレスのソケットを持ち続けずに済む。
+func CloseUnclaimed() int {
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	n := 0
+	for name, f := range inherited {
+		if !claimed[name] {
+			f.Close()
+			delete(inherited, name)
+			n++
+		}
+	}
+	return n
+}
+
+// activationName は "unix:/path" か "host:port" の形式の addr に対応する、systemd から受け取るソケットの名前を返す。
+// Unix ソケットは別のディレクトリにある同じ名前のソケットと取り違えないよう、パス全体を名前にする。
+func activationName(addr string) string {
+	if strings.HasPrefix(addr, "unix:") {
+		return filepath.Clean(strings.TrimPrefix(addr, "unix:"))
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return port
+	}
+	return addr
+}
+
+// listenerAddr は l のアドレスを listen に渡す形式で返す。
+func listenerAddr(l net.Listener) string {
+	if a, ok := l.Addr().(*net.UnixAddr); ok {
+		return "unix:" + a.Name
+	}
+	return l.Addr().String()
+}
+
+// Notify は systemd に state を通知する。NOTIFY_SOCKET が設定されていない場合は何もしない。
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// "@" で始まる場合は抽象名前空間のソケット
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// NotifyReloading は systemd に設定の再読み込みを始めたことを通知する。
+// Type=notify-reload のサービスで必要な MONOTONIC_USEC も付ける。
+func NotifyReloading() error {
+	state := "RELOADING=1"
+	if usec := monotonicUsec(); usec > 0 {
+		state += "\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10)
+	}
+	return Notify(state)
+}
+
+// WatchdogInterval は systemd の WatchdogSec= に応じて WATCHDOG=1 を通知すべき間隔を返す。
+// ウォッチドッグが有効でない場合は 0 を返す。
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// 取りこぼしても間に合うよう、制限時間の半分の間隔で通知する
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// clockMonotonic は clock_gettime(2) の CLOCK_MONOTONIC。
+const clockMonotonic = 1
+
+// monotonicUsec は systemd が MONOTONIC_USEC として求める CLOCK_MONOTONIC の現在時刻をマイクロ秒で返す。
+func monotonicUsec() int64 {
+	var ts syscall.Timespec
+	if _, _, e := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0); e != 0 {
+		return 0
+	}
+	return ts.Nano() / 1000
+}
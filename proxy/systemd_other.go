@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+// monotonicUsec は Linux 以外では 0 を返す。
+func monotonicUsec() int64 {
+	return 0
+}
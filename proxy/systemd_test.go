@@ -0,0 +1,228 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// notifySocket は NOTIFY_SOCKET に設定する名前 name で systemd の代わりに通知を受け取るソケットを作る。
+func notifySocket(t *testing.T, name string) func() string {
+	t.Helper()
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return func() string {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestNotify(t *testing.T) {
+	recv := notifySocket(t, filepath.Join(t.TempDir(), "notify.sock"))
+	if err := Notify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := recv(); got != "READY=1" {
+		t.Errorf("got %q, want READY=1", got)
+	}
+
+	if err := NotifyReloading(); err != nil {
+		t.Fatal(err)
+	}
+	got := recv()
+	if runtime.GOOS != "linux" {
+		if got != "RELOADING=1" {
+			t.Errorf("got %q, want RELOADING=1", got)
+		}
+	} else if usec, err := strconv.ParseInt(strings.TrimPrefix(got, "RELOADING=1\nMONOTONIC_USEC="), 10, 64); err != nil || usec <= 0 {
+		t.Errorf("got %q, want RELOADING=1 with MONOTONIC_USEC", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("without NOTIFY_SOCKET: %v", err)
+	}
+}
+
+// TestNotifyAbstract は "@" で始まる NOTIFY_SOCKET を抽象名前空間のソケットとして扱うことを確かめる。
+func TestNotifyAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are linux only")
+	}
+	recv := notifySocket(t, "@proxy-relay-test-"+strconv.Itoa(os.Getpid()))
+	if err := Notify("STOPPING=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := recv(); got != "STOPPING=1" {
+		t.Errorf("got %q, want STOPPING=1", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 15 * time.Second},
+		{"30000000", pid, 15 * time.Second},
+		{"30000000", "1", 0},
+		{"0", "", 0},
+		{"-1", "", 0},
+		{"30s", "", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := WatchdogInterval(); got != tt.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %v, want %v", tt.usec, tt.pid, got, tt.want)
+		}
+	}
+}
+
+// listenEnv は TestInheritListeners で実行し直したプロセスに、受け取ったソケットで待ち受けるアドレスを渡す環境変数。
+const listenEnv = "PROXY_RELAY_TEST_LISTEN"
+
+// TestInheritListeners は LISTEN_FDS で渡されたソケットを FileDescriptorName の名前かソケットのアドレスで受け取り、
+// 同じアドレスで待ち受ける際に使うことを確かめる。ソケットはファイルディスクリプタ 3 から渡す必要があるため、
+// 自分自身をソケットを渡して実行し直し、その中で確かめる。
+func TestInheritListeners(t *testing.T) {
+	if addrs := os.Getenv(listenEnv); addrs != "" {
+		inheritChild(t, strings.Split(addrs, "\n"))
+		return
+	}
+
+	// 別のディレクトリにある同じファイル名の Unix ソケットを区別できること。最後のソケットは待ち受けに使わない
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a", "http.sock"), filepath.Join(dir, "b", "http.sock")}
+	var files []*os.File
+	var addrs []string
+	for _, network := range []string{"tcp", "unix", "unix", "tcp"} {
+		addr := "127.0.0.1:0"
+		if network == "unix" {
+			addr = paths[len(addrs)-1]
+			if err := os.Mkdir(filepath.Dir(addr), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(filer).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, listenerAddr(l))
+	}
+	port := strings.TrimPrefix(addrs[0], "127.0.0.1:")
+
+	// a は名前を付けずにアドレスで、b はパスの名前で対応させる
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritListeners$", "-test.timeout=1m")
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenEnv+"="+strings.Join(addrs[:3], "\n"),
+		"LISTEN_FDS=4",
+		"LISTEN_FDNAMES="+port+":unknown:"+paths[1]+":",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+// inheritChild は TestInheritListeners で実行し直したプロセスで、受け取ったソケットを addrs で待ち受ける際に使うことを確かめる。
+func inheritChild(t *testing.T, addrs []string) {
+	// 別のプロセス宛ての LISTEN_FDS は受け取らない
+	t.Setenv("LISTEN_PID", "1")
+	if n, err := InheritListeners(); n != 0 || err != nil {
+		t.Fatalf("InheritListeners for pid 1 = %d, %v", n, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("LISTEN_FDS was not unset")
+	}
+	os.Setenv("LISTEN_FDS", "4")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	n, err := InheritListeners()
+	if n != 4 || err != nil {
+		t.Fatalf("InheritListeners = %d, %v", n, err)
+	}
+	for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if v := os.Getenv(k); v != "" {
+			t.Errorf("%s = %q was not unset", k, v)
+		}
+	}
+
+	// 親のプロセスが同じアドレスで待ち受けているため、受け取ったソケットを使わなければ listen は失敗する
+	for _, addr := range addrs {
+		l, err := listen(addr, config.SocketOptions{UID: -1, GID: -1})
+		if err != nil {
+			t.Errorf("%s: %v", addr, err)
+			continue
+		}
+		if got := listenerAddr(l); got != addr {
+			t.Errorf("listen(%s) used the socket for %s", addr, got)
+			l.Close()
+			continue
+		}
+		network, a := "tcp", addr
+		if strings.HasPrefix(addr, "unix:") {
+			network, a = "unix", strings.TrimPrefix(addr, "unix:")
+		}
+		c, err := net.Dial(network, a)
+		if err != nil {
+			t.Errorf("%s: %v", addr, err)
+		} else if s, err := l.Accept(); err != nil {
+			t.Errorf("%s: %v", addr, err)
+		} else {
+			s.Close()
+			c.Close()
+		}
+		l.Close()
+	}
+	// 待ち受けに使わなかった最後のソケットだけを閉じる
+	if n := CloseUnclaimed(); n != 1 {
+		t.Errorf("CloseUnclaimed = %d, want 1", n)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(listenFdsStart+3, &st); err != syscall.EBADF {
+		t.Errorf("unused socket was not closed: %v", err)
+	}
+	if n := CloseUnclaimed(); n != 0 {
+		t.Errorf("second CloseUnclaimed = %d, want 0", n)
+	}
+	for _, addr := range addrs {
+		l, err := listen(addr, config.SocketOptions{UID: -1, GID: -1})
+		if err != nil {
+			t.Errorf("after CloseUnclaimed: %s: %v", addr, err)
+			continue
+		}
+		l.Close()
+	}
+}
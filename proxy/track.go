@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tracker は処理中の接続を管理し、終了時にそれらが完了するのを待つために使用する。
+// Based on github.com/stretchr/graceful Copyright (c) 2014 Stretchr, Inc.
+type tracker struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool
+	idle     chan struct{} // draining 中に接続が無くなった時に閉じられる
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		conns: make(map[net.Conn]struct{}),
+		idle:  make(chan struct{}),
+	}
+}
+
+// add は c を処理中の接続として登録する。
+func (t *tracker) add(c net.Conn) {
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+}
+
+// remove は c の処理が完了したことを記録する。
+func (t *tracker) remove(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[c]; !ok {
+		return
+	}
+	delete(t.conns, c)
+	if t.draining && len(t.conns) == 0 {
+		t.signalIdle()
+	}
+}
+
+// count は処理中の接続の数を返す。
+func (t *tracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// signalIdle は drain で待っている側に接続が無くなったことを通知する。t.mu を確保した状態で呼ぶこと。
+func (t *tracker) signalIdle() {
+	select {
+	case <-t.idle:
+	default:
+		close(t.idle)
+	}
+}
+
+// drain は処理中の接続が全て終わるのを最大 timeout まで待つ。
+// timeout を過ぎても残っている接続は強制的に閉じ、その数を返す。
+// timeout が 0 以下の場合は全て終わるまで待ち続ける。
+func (t *tracker) drain(timeout time.Duration) int {
+	t.mu.Lock()
+	if !t.draining {
+		t.draining = true
+		if len(t.conns) == 0 {
+			t.signalIdle()
+		}
+	}
+	t.mu.Unlock()
+
+	if timeout <= 0 {
+		<-t.idle
+		return 0
+	}
+
+	select {
+	case <-t.idle:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.conns)
+	for c := range t.conns {
+		c.Close()
+	}
+	return n
+}
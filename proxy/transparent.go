@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// sniffTimeout はクライアントの最初のデータから接続先のホスト名を読み取る際に待つ最大時間。
+// サーバから先に話すプロトコルではこの時間だけ接続が遅れる。
+const sniffTimeout = 500 * time.Millisecond
+
+// Transparent は iptables や nftables の REDIRECT で転送されてきた接続を受け付け、
+// 本来の接続先へ上流の SOCKS プロキシを経由して中継する透過プロキシ。Linux でのみ動作する。
+type Transparent struct {
+	Logger       *log.Logger
+	DrainTimeout time.Duration   // Close の際に処理中の接続の完了を待つ最大時間
+	Timeouts     config.Timeouts // 中継する接続の時間制限
+	Resolver     *Resolver       // 接続先のホスト名を上流へ渡す前に名前解決する設定。nil の場合は名前のまま渡す
+	Blocker      *Blocker        // 接続を拒否する接続先の一覧。nil の場合は拒否しない
+	Sniff        bool            // TLS の SNI や HTTP の Host ヘッダから接続先のホスト名を読み取るかどうか
+	listener     net.Listener
+	proxy        *config.Proxy
+	conns        *tracker
+	closed       chan struct{}
+}
+
+// NewTransparent は新しい透過プロキシを作成する。実際に使用するプロキシ設定は proxy で指定する。
+func NewTransparent(proxy *config.Proxy) *Transparent {
+	return &Transparent{
+		Logger:       log.New(os.Stderr, "", log.LstdFlags),
+		DrainTimeout: 1 * time.Second,
+		proxy:        proxy,
+		conns:        newTracker(),
+		closed:       make(chan struct{}),
+	}
+}
+
+// ListenAndServe は addr で Listen して通信の待受状態に入る。
+// Listen が成功したかどうかを errch を通じて返し、Serve の結果は Logger を経由して出力する。
+func (srv *Transparent) ListenAndServe(addr string, errch chan<- error) {
+	if !transparentSupported {
+		errch <- errors.New("transparent proxy is not supported on " + runtime.GOOS)
+		return
+	}
+	l, err := listen(addr, config.SocketOptions{UID: -1, GID: -1})
+	if err == nil {
+		srv.listener = l
+	}
+	errch <- err
+	if err != nil {
+		return
+	}
+
+	defer close(srv.closed)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			if oe, ok := err.(*net.OpError); !ok || oe.Err.Error() != "use of closed network connection" {
+				srv.Logger.Println("ListenAndServe:", err)
+			}
+			return
+		}
+		srv.conns.add(c)
+		go srv.serve(c)
+	}
+}
+
+// Close は Listen を終了し、処理中の接続が完了するのを DrainTimeout まで待つ。
+func (srv *Transparent) Close() error {
+	return srv.Shutdown(srv.DrainTimeout)
+}
+
+// Shutdown は Listen を終了して新しい接続の受付を止め、処理中の接続が完了するのを最大 timeout まで待つ。
+func (srv *Transparent) Shutdown(timeout time.Duration) error {
+	err := srv.listener.Close()
+	<-srv.closed
+	if n := srv.conns.drain(timeout); n > 0 {
+		srv.Logger.Printf("%s: closed %d transparent connections after %v", srv.listener.Addr(), n, timeout)
+	}
+	return err
+}
+
+// serve は c の本来の接続先を調べ、上流を経由して中継する。
+func (srv *Transparent) serve(c net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 4096
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			srv.Logger.Printf("panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
+		}
+		c.Close()
+		srv.conns.remove(c)
+	}()
+
+	dst, err := originalDst(c)
+	if err != nil {
+		srv.Logger.Printf("transparent: %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	// REDIRECT されずに直接繋いできた接続は自分自身に繋がってしまうため断る
+	if la, ok := c.LocalAddr().(*net.TCPAddr); ok && la.IP.Equal(dst.IP) && la.Port == dst.Port {
+		srv.Logger.Printf("transparent: %s: not a redirected connection", c.RemoteAddr())
+		return
+	}
+
+	target := dst.String()
+	if srv.Sniff {
+		host, peeked := sniffHost(c, sniffTimeout)
+		if host != "" && net.ParseIP(host) == nil {
+			target = net.JoinHostPort(host, strconv.Itoa(dst.Port))
+		}
+		if len(peeked) > 0 {
+			c = &prefixConn{Conn: c, r: io.MultiReader(bytes.NewReader(peeked), c)}
+		}
+	}
+
+	if srv.Blocker.blockConn(target, c.RemoteAddr().String(), srv.Logger) {
+		return
+	}
+	addr, err := srv.Resolver.Resolve(target)
+	if err != nil {
+		srv.Logger.Printf("transparent: %v", err)
+		return
+	}
+	if _, err := connectSOCKS(c, addr, srv.proxy, nil, srv.Timeouts, nil); err != nil {
+		srv.Logger.Println("connectSOCKS:", err)
+	}
+}
+
+// prefixConn は先に読み出したデータを返してから続きを元の接続から読む。
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+var errSniffed = errors.New("sniffed")
+
+// sniffHost はクライアントが最初に送ってきた TLS の ClientHello の SNI か HTTP の Host ヘッダからホスト名を読み取る。
+// timeout までに読み取れなかった場合は host が空になる。
+// peeked は読み取りのために c から読み出したデータで、上流へそのまま送る必要がある。
+func sniffHost(c net.Conn, timeout time.Duration) (host string, peeked []byte) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var buf bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(c, &buf))
+	first, err := br.Peek(1)
+	if err != nil {
+		return "", buf.Bytes()
+	}
+	if first[0] == 0x16 {
+		// TLS のハンドシェイクを ClientHello を受け取った所で打ち切る
+		tls.Server(&sniffConn{r: br}, &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				host = hello.ServerName
+				return nil, errSniffed
+			},
+		}).Handshake()
+		return host, buf.Bytes()
+	}
+	if r, err := http.ReadRequest(br); err == nil {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	return host, buf.Bytes()
+}
+
+// sniffConn は sniffHost で TLS の ClientHello を読むための読み込み専用の接続。書き込みは捨てる。
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *sniffConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *sniffConn) Close() error                       { return nil }
+func (c *sniffConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *sniffConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *sniffConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sniffConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sniffConn) SetWriteDeadline(t time.Time) error { return nil }
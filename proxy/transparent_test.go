@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// sniffed は client が書き込むデータを sniffHost で読み取り、読み取ったホスト名と
+// 先に読み出したデータを戻した prefixConn を返す。
+func sniffed(t *testing.T, client func(c net.Conn)) (host string, c net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	go client(a)
+	host, peeked := sniffHost(b, 200*time.Millisecond)
+	return host, &prefixConn{Conn: b, r: io.MultiReader(bytes.NewReader(peeked), b)}
+}
+
+// TestSniffTLS は ClientHello の SNI を読み取り、読み出したデータを戻した接続でそのままハンドシェイクを続けられることを確かめる。
+func TestSniffTLS(t *testing.T) {
+	cert, err := SelfSignedCertificate([]string{"git.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"git.example.com", ""} {
+		result := make(chan string, 1)
+		host, c := sniffed(t, func(c net.Conn) {
+			tc := tls.Client(c, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+			if err := tc.Handshake(); err != nil {
+				result <- err.Error()
+				return
+			}
+			b, _ := io.ReadAll(tc)
+			result <- string(b)
+		})
+		if host != name {
+			t.Errorf("sniffed host = %q, want %q", host, name)
+		}
+		tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{*cert}})
+		if err := tc.Handshake(); err != nil {
+			t.Fatalf("%q: handshake after sniffing: %v", name, err)
+		}
+		io.WriteString(tc, "hello")
+		tc.Close()
+		if got := <-result; got != "hello" {
+			t.Errorf("%q: client got %q, want %q", name, got, "hello")
+		}
+	}
+}
+
+// TestSniffHTTP は HTTP の Host ヘッダからポート番号を除いたホスト名を読み取り、リクエストが欠けずに読めることを確かめる。
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		req  string
+		host string
+	}{
+		{"POST /a HTTP/1.1\r\nHost: wiki.example.com\r\nContent-Length: 4\r\n\r\nbody", "wiki.example.com"},
+		{"POST /a HTTP/1.1\r\nHost: ci.example.com:8080\r\nContent-Length: 4\r\n\r\nbody", "ci.example.com"},
+		{"POST /a HTTP/1.1\r\nHost: [::1]:8080\r\nContent-Length: 4\r\n\r\nbody", "::1"},
+		{"POST /a HTTP/1.0\r\nContent-Length: 4\r\n\r\nbody", ""},
+	}
+	for _, tt := range tests {
+		host, c := sniffed(t, func(c net.Conn) { io.WriteString(c, tt.req) })
+		if host != tt.host {
+			t.Errorf("%q: sniffed host = %q, want %q", tt.req, host, tt.host)
+		}
+		r, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			t.Errorf("%q: %v", tt.req, err)
+			continue
+		}
+		if b, err := io.ReadAll(r.Body); err != nil || string(b) != "body" {
+			t.Errorf("%q: body = %q, %v", tt.req, b, err)
+		}
+	}
+}
+
+// TestSniffTimeout はクライアントから何も送られてこない場合に、ホスト名を読み取れないまま時間内に戻ることを確かめる。
+func TestSniffTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	start := time.Now()
+	host, peeked := sniffHost(b, 50*time.Millisecond)
+	if host != "" || len(peeked) != 0 {
+		t.Errorf("sniffHost = %q, %q, want nothing", host, peeked)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("sniffHost took %v", d)
+	}
+
+	// 読み込みの期限が解除されていること
+	go io.WriteString(a, "x")
+	buf := make([]byte, 1)
+	if _, err := b.Read(buf); err != nil {
+		t.Errorf("read after sniffing: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// isUpgrade は r が Connection: Upgrade によるプロトコル切り替えのリクエストかを返す。
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade は WebSocket などのプロトコル切り替えのリクエストを上流の HTTP プロキシへ送り、
+// 101 が返ってきた場合はクライアントの接続を Hijack して以後の通信を双方向に中継する。
+func (srv *HTTP) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "does not support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	switch out.URL.Scheme {
+	case "ws":
+		out.URL.Scheme = "http"
+	case "wss":
+		out.URL.Scheme = "https"
+	}
+	setForwardHeaders(out, r, &srv.Headers)
+	applyHeaderRules(out, srv.HeaderRules)
+	if out.URL.Scheme == "http" {
+		port := out.URL.Port()
+		if port == "" {
+			port = "80"
+		}
+		hostport := net.JoinHostPort(out.URL.Hostname(), port)
+		addr, err := srv.Resolver.Resolve(hostport)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			srv.Logger.Println("serveUpgrade:", err)
+			return
+		}
+		if addr != hostport {
+			setRequestAddr(out, addr)
+		}
+	}
+	if _, ok := out.Header["User-Agent"]; !ok {
+		// Request.Write が既定の User-Agent を付けないようにする
+		out.Header.Set("User-Agent", "")
+	}
+	if srv.proxy.Username != "" || srv.proxy.Password != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(srv.proxy.Username + ":" + srv.proxy.Password))
+		out.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+
+	addr := srv.proxy.Host + ":" + strconv.Itoa(srv.proxy.HTTPPort)
+	conn, err := net.DialTimeout("tcp", addr, srv.Timeouts.Dial)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		srv.Logger.Println("serveUpgrade:", err)
+		return
+	}
+	defer conn.Close()
+
+	if err = out.WriteProxy(conn); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		srv.Logger.Println("serveUpgrade:", err)
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		srv.Logger.Println("serveUpgrade:", err)
+		return
+	}
+
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, srv.Headers.Via)
+	applyResponseHeaderRules(resp, srv.HeaderRules)
+
+	// 切り替えが拒否された場合は通常のレスポンスとして返す
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		for k, vv := range resp.Header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	c, brw, err := hij.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		srv.Logger.Println("could not hijack:", err)
+		return
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 4096
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			srv.Logger.Printf("panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
+		}
+		c.Close()
+		srv.conns.remove(c)
+	}()
+
+	if err = resp.Write(c); err != nil {
+		srv.Logger.Println("serveUpgrade:", err)
+		return
+	}
+
+	// ヘッダの読み取り時にバッファに入った分を先に送ってから中継を始める
+	if err = flushBuffered(c, br); err != nil {
+		srv.Logger.Println("serveUpgrade:", err)
+		return
+	}
+	if err = flushBuffered(conn, brw.Reader); err != nil {
+		srv.Logger.Println("serveUpgrade:", err)
+		return
+	}
+
+	if err = pipe(c, conn, srv.Timeouts); err != nil {
+		if isTimeout(err) {
+			err = fmt.Errorf("%s: closed: %v", r.URL.Host, err)
+		}
+		srv.Logger.Println("serveUpgrade:", err)
+	}
+}
+
+// flushBuffered は br に読み込み済みのデータを全て w に書き込む。
+func flushBuffered(w io.Writer, br *bufio.Reader) error {
+	n := br.Buffered()
+	if n == 0 {
+		return nil
+	}
+	b, err := br.Peek(n)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// wsAccept は Sec-WebSocket-Key に対する Sec-WebSocket-Accept の値を返す。
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// writeFrame は 125 バイトまでの payload を WebSocket のフレームとして書き込む。クライアントからの場合は mask する。
+func writeFrame(w io.Writer, op byte, payload []byte, mask bool) error {
+	if len(payload) > 125 {
+		return errors.New("payload too large")
+	}
+	b := []byte{0x80 | op, byte(len(payload))}
+	if !mask {
+		_, err := w.Write(append(b, payload...))
+		return err
+	}
+	b[1] |= 0x80
+	key := []byte{1, 2, 3, 4}
+	b = append(b, key...)
+	for i, c := range payload {
+		b = append(b, c^key[i%4])
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame は WebSocket のフレームをひとつ読み込み、opcode と mask を外した payload を返す。
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		return 0, nil, errors.New("frame too large")
+	}
+	var key [4]byte
+	masked := h[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return h[0] & 0x0f, payload, nil
+}
+
+// wsEcho は受け取ったメッセージをそのまま返す WebSocket のエコーサーバ。
+func wsEcho(w http.ResponseWriter, r *http.Request) {
+	if !isUpgrade(r) || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "websocket only", http.StatusBadRequest)
+		return
+	}
+	c, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	if brw.Flush() != nil {
+		return
+	}
+	for {
+		op, payload, err := readFrame(brw)
+		if err != nil {
+			return
+		}
+		if err = writeFrame(c, op, payload, false); err != nil || op == 8 {
+			return
+		}
+	}
+}
+
+// fakeUpstream は絶対 URI のリクエストを接続先へ送り、以後の通信を双方向に中継する上流の HTTP プロキシ。
+// https のリクエストは TLS で接続先へ送る。CONNECT は接続先へのトンネルを作る。受け取ったリクエストの URI を記録する。
+type fakeUpstream struct {
+	l    net.Listener
+	mu   sync.Mutex
+	uris []string
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &fakeUpstream{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(c)
+		}
+	}()
+	return u
+}
+
+func (u *fakeUpstream) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	u.mu.Lock()
+	u.uris = append(u.uris, req.RequestURI)
+	u.mu.Unlock()
+
+	if req.Method == "CONNECT" {
+		conn, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		defer conn.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(conn, br)
+		io.Copy(c, conn)
+		return
+	}
+
+	var conn net.Conn
+	if req.URL.Scheme == "https" {
+		conn, err = tls.Dial("tcp", req.URL.Host, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.Dial("tcp", req.URL.Host)
+	}
+	if err != nil {
+		io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer conn.Close()
+	req.Header.Del("Proxy-Authorization")
+	if err = req.Write(conn); err != nil {
+		return
+	}
+	go io.Copy(conn, br)
+	io.Copy(c, conn)
+}
+
+func (u *fakeUpstream) port() int {
+	return u.l.Addr().(*net.TCPAddr).Port
+}
+
+// TestUpgradeWebSocket は ws:// と wss:// の WebSocket のリクエストが上流の HTTP プロキシを経由してエコーサーバに届き、
+// 101 の後にメッセージを双方向にやり取りできることを確かめる。
+func TestUpgradeWebSocket(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(wsEcho))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(wsEcho))
+	defer secure.Close()
+
+	upstream := newFakeUpstream(t)
+	defer upstream.l.Close()
+
+	srv := NewHTTP(&config.Proxy{Host: "127.0.0.1", HTTPPort: upstream.port()})
+	srv.Timeouts = config.Timeouts{Dial: 5 * time.Second}
+	errch := make(chan error, 1)
+	go srv.ListenAndServe("127.0.0.1:0", errch)
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	proxyAddr := srv.listener.Addr().String()
+
+	for _, tc := range []struct {
+		scheme   string
+		host     string
+		upstream string // 上流の HTTP プロキシが受け取るべき URI のスキーム
+	}{
+		{"ws", plain.Listener.Addr().String(), "http"},
+		{"wss", secure.Listener.Addr().String(), "https"},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			c, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+			req := "GET " + tc.scheme + "://" + tc.host + "/echo HTTP/1.1\r\nHost: " + tc.host + "\r\n" +
+				"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + key + "\r\n\r\n"
+			if _, err := io.WriteString(c, req); err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(c)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want 101", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != wsAccept(key) {
+				t.Errorf("Sec-WebSocket-Accept %q, want %q", got, wsAccept(key))
+			}
+
+			for i := 0; i < 3; i++ {
+				msg := []byte("hello " + strconv.Itoa(i))
+				if err := writeFrame(c, 1, msg, true); err != nil {
+					t.Fatal(err)
+				}
+				op, payload, err := readFrame(br)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if op != 1 || string(payload) != string(msg) {
+					t.Errorf("received opcode %d %q, want 1 %q", op, payload, msg)
+				}
+			}
+			if err := writeFrame(c, 8, nil, true); err != nil {
+				t.Fatal(err)
+			}
+			if op, _, err := readFrame(br); err != nil || op != 8 {
+				t.Errorf("received opcode %d (%v), want close", op, err)
+			}
+
+			upstream.mu.Lock()
+			uris := upstream.uris
+			upstream.mu.Unlock()
+			want := tc.upstream + "://" + tc.host + "/echo"
+			if len(uris) == 0 || uris[len(uris)-1] != want {
+				t.Errorf("upstream received %q, want %q", uris, want)
+			}
+		})
+	}
+}
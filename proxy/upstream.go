@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// Upstream は上流の HTTP プロキシへの接続プール。
+// 全ての HTTP ポートで共有し、上流の設定が変わらない限り設定の再読み込みをまたいで使いまわす。
+type Upstream struct {
+	proxy     config.Proxy
+	opt       config.Transport
+	dial      time.Duration
+	transport *http.Transport
+
+	open     int64 // 現在開いている上流への接続数
+	active   int64 // 処理中のリクエスト数
+	dials    int64 // これまでに上流へ接続した回数
+	requests int64 // これまでに処理したリクエスト数
+	reused   int64 // 待機中の接続を再利用したリクエスト数
+}
+
+// UpstreamStats は Upstream の接続プールの状態。
+type UpstreamStats struct {
+	Open     int64 // 開いている接続数
+	Idle     int64 // 待機中の接続数 (開いている接続数から処理中のリクエスト数を引いた概算)
+	Active   int64 // 処理中のリクエスト数
+	Dials    int64 // これまでに接続した回数
+	Requests int64 // これまでに処理したリクエスト数
+	Reused   int64 // 接続を再利用したリクエスト数
+}
+
+// NewUpstream は pc の HTTP プロキシに接続する新しい Upstream を作成する。
+// dial は上流への接続にかける最大時間。
+func NewUpstream(pc *config.Proxy, opt config.Transport, dial time.Duration) *Upstream {
+	u := &Upstream{
+		proxy: *pc,
+		opt:   opt,
+		dial:  dial,
+	}
+	d := &net.Dialer{
+		Timeout:   dial,
+		KeepAlive: keepAlivePeriod,
+	}
+	proxyURL := &url.URL{
+		Host: pc.Host + ":" + strconv.Itoa(pc.HTTPPort),
+		User: url.UserPassword(pc.Username, pc.Password),
+	}
+	u.transport = &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			// 接続先を置き換える HTTPS のリクエストは dialTLS が自分で上流へ CONNECT する
+			if r.URL.Scheme == "https" && connectAddr(r.Context()) != "" {
+				return nil, nil
+			}
+			return proxyURL, nil
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&u.dials, 1)
+			atomic.AddInt64(&u.open, 1)
+			return &countedConn{Conn: c, open: &u.open}, nil
+		},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return u.dialTLS(ctx, addr, connectAddr(ctx))
+		},
+		MaxIdleConnsPerHost:   opt.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opt.IdleConnTimeout,
+		ResponseHeaderTimeout: opt.ResponseHeaderTimeout,
+	}
+	return u
+}
+
+// dialTLS は上流の HTTP プロキシに connect への CONNECT を送り、そのトンネルの中で addr のホスト名で TLS を開始する。
+// [hosts] や resolve で接続先を IP アドレスに置き換えた HTTPS のリクエストで、証明書をホスト名で検証するために使う。
+func (u *Upstream) dialTLS(ctx context.Context, addr, connect string) (net.Conn, error) {
+	if connect == "" {
+		return nil, fmt.Errorf("%s: no address to CONNECT", addr)
+	}
+	c, err := u.transport.DialContext(ctx, "tcp", u.proxy.Host+":"+strconv.Itoa(u.proxy.HTTPPort))
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	} else if u.dial > 0 {
+		c.SetDeadline(time.Now().Add(u.dial))
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: connect},
+		Host:   connect,
+		Header: make(http.Header),
+	}
+	if u.proxy.Username != "" || u.proxy.Password != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(u.proxy.Username + ":" + u.proxy.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err = req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", connect, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		c.Close()
+		return nil, fmt.Errorf("CONNECT %s: unexpected data after response", connect)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	cfg := &tls.Config{}
+	if u.transport.TLSClientConfig != nil {
+		cfg = u.transport.TLSClientConfig.Clone()
+	}
+	cfg.ServerName = host
+	cfg.NextProtos = []string{"http/1.1"}
+	tc := tls.Client(c, cfg)
+	if err = tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// Matches は u が pc と opt と dial の設定で作成されたものと同じ接続先と設定かを返す。
+func (u *Upstream) Matches(pc *config.Proxy, opt config.Transport, dial time.Duration) bool {
+	return u.proxy == *pc && u.opt == opt && u.dial == dial
+}
+
+// RoundTrip は上流のプロキシを経由してリクエストを送る。
+func (u *Upstream) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&u.requests, 1)
+	atomic.AddInt64(&u.active, 1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&u.reused, 1)
+			}
+		},
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+	resp, err := u.transport.RoundTrip(r)
+	if err != nil {
+		atomic.AddInt64(&u.active, -1)
+		return nil, err
+	}
+	// レスポンスボディを読み終わるまでは接続を使用中として扱う。
+	// 101 の場合はボディが io.ReadWriteCloser であることを前提に使われるため包まない。
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		atomic.AddInt64(&u.active, -1)
+		return resp, nil
+	}
+	resp.Body = &countedBody{ReadCloser: resp.Body, active: &u.active}
+	return resp, nil
+}
+
+// Stats は接続プールの状態を返す。
+func (u *Upstream) Stats() UpstreamStats {
+	st := UpstreamStats{
+		Open:     atomic.LoadInt64(&u.open),
+		Active:   atomic.LoadInt64(&u.active),
+		Dials:    atomic.LoadInt64(&u.dials),
+		Requests: atomic.LoadInt64(&u.requests),
+		Reused:   atomic.LoadInt64(&u.reused),
+	}
+	if st.Idle = st.Open - st.Active; st.Idle < 0 {
+		st.Idle = 0
+	}
+	return st
+}
+
+// CloseIdleConnections は待機中の接続を閉じる。使われなくなった Upstream を手放す時に呼ぶ。
+func (u *Upstream) CloseIdleConnections() {
+	u.transport.CloseIdleConnections()
+}
+
+// countedConn は閉じられた時に開いている接続数を減らす。
+type countedConn struct {
+	net.Conn
+	open *int64
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.open, -1) })
+	return c.Conn.Close()
+}
+
+// countedBody は閉じられた時に処理中のリクエスト数を減らす。
+type countedBody struct {
+	io.ReadCloser
+	active *int64
+	once   sync.Once
+}
+
+func (b *countedBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(b.active, -1) })
+	return b.ReadCloser.Close()
+}
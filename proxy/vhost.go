@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// VHost は HTTP の Host ヘッダを見てリクエストごとに接続先を選び、上流の SOCKS プロキシを経由して中継するリバースプロキシ。
+// Keep-Alive の接続でもリクエストごとに振り分け直す。
+type VHost struct {
+	Logger       *log.Logger
+	DrainTimeout time.Duration   // Close の際に処理中の接続の完了を待つ最大時間
+	Timeouts     config.Timeouts // Dial を接続先への接続の、Idle を待機中の Keep-Alive 接続の時間制限に使う
+	Resolver     *Resolver       // 接続先のホスト名を上流へ渡す前に名前解決する設定。nil の場合は名前のまま渡す
+	listener     net.Listener
+	server       *http.Server
+	transport    *http.Transport
+	route        *config.VHostRoute
+	proxy        *config.Proxy
+	conns        *tracker
+}
+
+// NewVHost は route に従って振り分ける新しいリバースプロキシを作成する。
+// 実際に使用するプロキシ設定は proxy で指定する。
+func NewVHost(route *config.VHostRoute, proxy *config.Proxy) *VHost {
+	return &VHost{
+		Logger:       log.New(os.Stderr, "", log.LstdFlags),
+		DrainTimeout: 1 * time.Second,
+		route:        route,
+		proxy:        proxy,
+		conns:        newTracker(),
+	}
+}
+
+// ListenAndServe は addr で Listen して通信の待受状態に入る。
+// Listen が成功したかどうかを errch を通じて返し、Serve の結果は Logger を経由して出力する。
+func (srv *VHost) ListenAndServe(addr string, errch chan<- error) {
+	l, err := listen(addr, config.SocketOptions{UID: -1, GID: -1})
+	if err == nil {
+		srv.init(l)
+	}
+	errch <- err
+	if err != nil {
+		return
+	}
+
+	if err = srv.server.Serve(l); err != nil {
+		if oe, ok := err.(*net.OpError); !ok || oe.Err.Error() != "use of closed network connection" {
+			srv.Logger.Println("ListenAndServe:", err)
+		}
+	}
+}
+
+// Close は Listen していたポートを開放し、処理中の接続が完了するのを DrainTimeout まで待つ。
+func (srv *VHost) Close() error {
+	return srv.Shutdown(srv.DrainTimeout)
+}
+
+// Shutdown は Listen していたポートを開放して新しい接続の受付を止め、処理中のリクエストが完了するのを最大 timeout まで待つ。
+func (srv *VHost) Shutdown(timeout time.Duration) error {
+	err := srv.listener.Close()
+	srv.server.SetKeepAlivesEnabled(false)
+	if n := srv.conns.drain(timeout); n > 0 {
+		srv.Logger.Printf("%s: closed %d connections after %v", srv.listener.Addr(), n, timeout)
+	}
+	srv.transport.CloseIdleConnections()
+	return err
+}
+
+// init は l をリバースプロキシとして処理するための準備を行う。
+func (srv *VHost) init(l net.Listener) {
+	srv.listener = l
+
+	srv.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			a, err := srv.Resolver.Resolve(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialSOCKS(a, srv.proxy, srv.Timeouts.Dial)
+		},
+		MaxIdleConnsPerHost: config.DefaultTransport.MaxIdleConnsPerHost,
+		IdleConnTimeout:     config.DefaultTransport.IdleConnTimeout,
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			target := pr.In.Context().Value(vhostTargetKey{}).(string)
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = target
+			if srv.route.RewriteHost {
+				pr.Out.Host = target
+				if h, port, err := net.SplitHostPort(target); err == nil && port == "80" {
+					pr.Out.Host = h
+				}
+			}
+		},
+		Transport: srv.transport,
+		ErrorLog:  srv.Logger,
+	}
+	srv.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			target := srv.route.Target(hostOnly(r.Host))
+			if target == "" {
+				http.Error(w, "no route for host "+r.Host, http.StatusBadGateway)
+				srv.Logger.Printf("%s: no route for host %q", srv.listener.Addr(), r.Host)
+				return
+			}
+			// WebSocket などで Hijack された接続は ReverseProxy が中継を終えて閉じてから取り除く
+			defer func() {
+				if _, err := w.Write(nil); err == http.ErrHijacked {
+					srv.conns.remove(r.Context().Value(vhostConnKey{}).(net.Conn))
+				}
+			}()
+			rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), vhostTargetKey{}, target)))
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, vhostConnKey{}, c)
+		},
+		IdleTimeout: srv.Timeouts.Idle,
+		ErrorLog:    srv.Logger,
+	}
+
+	// 処理中の接続を記録する。
+	// Hijack された接続は以後通知されないため、ハンドラが終了時に取り除く。
+	srv.server.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateActive:
+			srv.conns.add(c)
+		case http.StateClosed, http.StateIdle:
+			srv.conns.remove(c)
+		}
+	}
+}
+
+type (
+	vhostTargetKey struct{} // ハンドラで選んだ接続先を Rewrite に渡すためのコンテキストのキー
+	vhostConnKey   struct{} // リクエストを受け取ったクライアントの接続を入れるコンテキストのキー
+)
+
+// hostOnly は "example.com:8080" のような Host ヘッダの値からポート番号を除く。
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/proxy-relay/config"
+)
+
+// TestVHostWebSocket は Host ヘッダで選んだ接続先と WebSocket でやり取りできること、
+// Hijack された接続が中継を終えるまで処理中として記録されることを確かめる。
+func TestVHostWebSocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(wsEcho))
+	defer backend.Close()
+	socks := startSOCKS(t)
+	defer socks.Close()
+
+	route := &config.VHostRoute{Routes: map[string]string{"ws.example": backend.Listener.Addr().String()}}
+	srv := NewVHost(route, &config.Proxy{Host: "127.0.0.1", SOCKSPort: socks.Addr().(*net.TCPAddr).Port})
+	srv.Logger.SetOutput(io.Discard)
+	srv.Timeouts = config.Timeouts{Dial: 5 * time.Second}
+	errch := make(chan error, 1)
+	go srv.ListenAndServe("127.0.0.1:0", errch)
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	req := "GET /echo HTTP/1.1\r\nHost: ws.example\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + key + "\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want 101", resp.StatusCode)
+	}
+
+	if err := writeFrame(c, 1, []byte("hello"), true); err != nil {
+		t.Fatal(err)
+	}
+	if op, payload, err := readFrame(br); err != nil || op != 1 || string(payload) != "hello" {
+		t.Fatalf("received opcode %d %q (%v), want 1 \"hello\"", op, payload, err)
+	}
+	if n := srv.conns.count(); n != 1 {
+		t.Errorf("%d connections tracked during WebSocket session, want 1", n)
+	}
+
+	if err := writeFrame(c, 8, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if op, _, err := readFrame(br); err != nil || op != 8 {
+		t.Errorf("received opcode %d (%v), want close", op, err)
+	}
+	c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.conns.count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("hijacked connection still tracked after it was closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}